@@ -0,0 +1,118 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// Background task starts a command in the background, runs body, and then
+// stops the background command regardless of the outcome of body.  Output
+// lines of the background command are prefixed with its name.
+func Background(start Task, body Task) Task {
+	return Task{
+		custom: func(r *runner) error {
+			if len(start.command) == 0 {
+				return errors.New("Background: start task is not a command")
+			}
+
+			name := Base(start.command[0])
+			logInfo("Starting", start.commandline())
+
+			prefixOut := newPrefixWriter(os.Stdout, "["+name+"] ")
+			prefixErr := newPrefixWriter(os.Stderr, "["+name+"] ")
+			defer prefixOut.flush()
+			defer prefixErr.flush()
+
+			// Secrets may be registered while the command is running.
+			stdout := &secretWriter{out: prefixOut}
+			stderr := &secretWriter{out: prefixErr}
+			defer stdout.flush()
+			defer stderr.flush()
+
+			env, err := start.environ()
+			if err != nil {
+				return err
+			}
+
+			cmd := exec.Command(start.command[0], start.command[1:]...)
+			cmd.Env = env
+			cmd.Dir = start.dir
+			cmd.Stdout = stdout
+			cmd.Stderr = stderr
+
+			p, err := startProcess(cmd)
+			if err != nil {
+				return err
+			}
+
+			_, err = r.run(body)
+
+			select {
+			case <-p.done:
+				if p.err != nil {
+					logWarningf("Background command %s exited early: %v", name, p.err)
+				}
+			default:
+				logInfo("Stopping", name)
+				p.stop()
+			}
+
+			return err
+		},
+		tag: new(tag),
+	}
+}
+
+// prefixWriter prepends a prefix to every line.
+type prefixWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	prefix []byte
+	buf    []byte // Incomplete line.
+}
+
+func newPrefixWriter(w io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{w: w, prefix: []byte(prefix)}
+}
+
+func (x *prefixWriter) Write(b []byte) (int, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.buf = append(x.buf, b...)
+
+	for {
+		i := bytes.IndexByte(x.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		line := append(append([]byte(nil), x.prefix...), x.buf[:i+1]...)
+		x.buf = x.buf[i+1:]
+
+		if _, err := x.w.Write(line); err != nil {
+			return len(b), err
+		}
+	}
+
+	return len(b), nil
+}
+
+// flush incomplete line.
+func (x *prefixWriter) flush() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if len(x.buf) > 0 {
+		x.w.Write(append(append(append([]byte(nil), x.prefix...), x.buf...), '\n'))
+		x.buf = nil
+	}
+}
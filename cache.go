@@ -0,0 +1,188 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// cacheVersion must be incremented when the format changes.  Cache files with
+// other versions are ignored.
+const cacheVersion = 1
+
+type cacheFile struct {
+	Version int                   `json:"version"`
+	Files   map[string]cacheEntry `json:"files"`
+	Targets map[string]string     `json:"targets"` // Digests of sources.
+}
+
+type cacheEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"` // Nanoseconds.
+	Hash    string `json:"hash"`
+}
+
+var cache struct {
+	mu       sync.Mutex
+	filename string
+	loaded   bool
+	dirty    bool
+	data     cacheFile
+}
+
+func init() {
+	cache.filename = ".make.cache"
+}
+
+// SetCacheFile changes the name of the file where OutdatedHash stores file
+// hashes between builds.  The default is ".make.cache".
+func SetCacheFile(filename string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.filename = filename
+	cache.loaded = false
+}
+
+// OutdatedHash condition is like Outdated, but compares the contents of the
+// sources (and the universal dependencies) with those seen during the last
+// successful build, instead of comparing modification times.  It is true if
+// the target doesn't exist or the contents have changed.
+//
+// Hashes are stored in a cache file (see SetCacheFile).  A file's hash is
+// reused if its size and modification time haven't changed.  The new digest
+// is recorded after the guarded tasks have been run successfully, and the
+// cache is written at the end of a successful build.
+func OutdatedHash(target string, sources func() []string) func() bool {
+	return func() bool {
+		deps := append([]string(nil), globalDeps...)
+		if sources != nil {
+			deps = append(deps, sources()...)
+		}
+		sort.Strings(deps)
+
+		h := sha256.New()
+		for _, source := range deps {
+			sum, err := hashFile(source)
+			if err != nil {
+				logWarningf("%s dependency %s: %v", target, source, err)
+				return true
+			}
+			io.WriteString(h, source+"\x00"+sum+"\x00")
+		}
+		digest := hex.EncodeToString(h.Sum(nil))
+
+		cache.mu.Lock()
+		loadCache()
+		old, found := cache.data.Targets[target]
+		cache.mu.Unlock()
+
+		if !found || old != digest {
+			recordOnSuccess(func() {
+				cache.mu.Lock()
+				defer cache.mu.Unlock()
+
+				loadCache()
+				cache.data.Targets[target] = digest
+				cache.dirty = true
+			})
+		}
+
+		return !Exists(target) || !found || old != digest
+	}
+}
+
+func hashFile(filename string) (string, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return "", err
+	}
+
+	cache.mu.Lock()
+	loadCache()
+	entry, found := cache.data.Files[filename]
+	cache.mu.Unlock()
+
+	if found && entry.Size == info.Size() && entry.ModTime == info.ModTime().UnixNano() {
+		return entry.Hash, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	entry = cacheEntry{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Hash:    hex.EncodeToString(h.Sum(nil)),
+	}
+
+	cache.mu.Lock()
+	cache.data.Files[filename] = entry
+	cache.dirty = true
+	cache.mu.Unlock()
+
+	return entry.Hash, nil
+}
+
+// loadCache must be called with mutex locked.  A missing, corrupt or
+// incompatible cache file is ignored.
+func loadCache() {
+	if cache.loaded {
+		return
+	}
+	cache.loaded = true
+
+	cache.data = cacheFile{}
+	if data, err := ioutil.ReadFile(cache.filename); err == nil {
+		if json.Unmarshal(data, &cache.data) != nil || cache.data.Version != cacheVersion {
+			cache.data = cacheFile{}
+		}
+	}
+
+	cache.data.Version = cacheVersion
+	if cache.data.Files == nil {
+		cache.data.Files = make(map[string]cacheEntry)
+	}
+	if cache.data.Targets == nil {
+		cache.data.Targets = make(map[string]string)
+	}
+}
+
+// saveCache if it has been modified.
+func saveCache() error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if !cache.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(&cache.data)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(cache.filename, data, 0644); err != nil {
+		return err
+	}
+
+	cache.dirty = false
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// CollapseOutput causes only every nth line of the command's output to be
+// printed, followed by a line count.  The full output is printed if the
+// command fails, or if the --verbose option is specified.  Returns a copy.
+func (task Task) CollapseOutput(everyN int) Task {
+	task.collapse = everyN
+	return task
+}
+
+// collapseWriter forwards every nth line and keeps the full output.
+type collapseWriter struct {
+	out     io.Writer
+	n       int
+	lines   int
+	partial []byte // Incomplete line.
+	full    bytes.Buffer
+}
+
+func (w *collapseWriter) Write(b []byte) (int, error) {
+	w.full.Write(b)
+	w.partial = append(w.partial, b...)
+
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := w.partial[:i+1]
+		w.partial = w.partial[i+1:]
+
+		w.lines++
+		if w.lines%w.n == 0 {
+			if _, err := w.out.Write(line); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return len(b), nil
+}
+
+// finish prints a summary, or the full output if the command failed.
+func (w *collapseWriter) finish(failed bool) {
+	if w.full.Len() == 0 {
+		return
+	}
+
+	if failed {
+		fmt.Fprintln(w.out, "Full output:")
+		w.out.Write(w.full.Bytes())
+		if !bytes.HasSuffix(w.full.Bytes(), []byte("\n")) {
+			fmt.Fprintln(w.out)
+		}
+		return
+	}
+
+	fmt.Fprintf(w.out, "(%d line(s) of output)\n", w.lines)
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"os"
+	"sort"
+	"strconv"
+)
+
+// ContainerCommand task runs a command in a new container (see
+// Env.ContainerCommand).
+func ContainerCommand(image string, command ...interface{}) Task {
+	return Env(nil).ContainerCommand(image, command...)
+}
+
+// ContainerCommand task runs a command in a new container using docker or
+// podman (whichever is found first).  The current directory is mounted at
+// the same path and used as the working directory.  The command runs with the
+// current user and group id.  The environment variables are set inside the
+// container.  The container is removed afterwards.  Program is terminated if
+// the current directory cannot be determined.
+func (env Env) ContainerCommand(image string, command ...interface{}) Task {
+	engine := LookPath("docker", "podman")
+	if engine == "" {
+		engine = "docker"
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		logError(err)
+		os.Exit(1)
+	}
+
+	args := []string{engine, "run", "--rm", "-v", wd + ":" + wd, "-w", wd}
+
+	if uid := os.Getuid(); uid >= 0 {
+		if engine == "podman" {
+			args = append(args, "--userns=keep-id")
+		} else {
+			args = append(args, "--user", strconv.Itoa(uid)+":"+strconv.Itoa(os.Getgid()))
+		}
+	}
+
+	var keys []string
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, "-e", k) // Expanded value is passed via environment.
+	}
+
+	return Task{
+		command: Flatten(args, image, command),
+		env:     env,
+		tag:     new(tag),
+	}
+}
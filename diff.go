@@ -0,0 +1,138 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// DiffDirs task compares two directory trees, and fails if some file exists
+// in only one of them or if the contents differ.  The differences are
+// printed.  Paths (relative to the directories, using slashes) which match
+// an ignore pattern (see path.Match) are skipped; a matching directory is
+// skipped entirely.
+func DiffDirs(a, b string, ignore ...string) Task {
+	return Func(func() error {
+		filesA, err := listTree(a, ignore)
+		if err != nil {
+			return err
+		}
+		filesB, err := listTree(b, ignore)
+		if err != nil {
+			return err
+		}
+
+		var names []string
+		for name := range filesA {
+			names = append(names, name)
+		}
+		for name := range filesB {
+			if _, found := filesA[name]; !found {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		var diffs int
+
+		for _, name := range names {
+			modeA, inA := filesA[name]
+			modeB, inB := filesB[name]
+
+			switch {
+			case !inB:
+				logError("Only in", a+":", name)
+			case !inA:
+				logError("Only in", b+":", name)
+			default:
+				same, err := sameFile(filepath.Join(a, name), filepath.Join(b, name), modeA, modeB)
+				if err != nil {
+					return err
+				}
+				if same {
+					continue
+				}
+				logError("Differs:", name)
+			}
+			diffs++
+		}
+
+		if diffs > 0 {
+			return fmt.Errorf("%d difference(s) between %s and %s", diffs, a, b)
+		}
+		return nil
+	})
+}
+
+// listTree returns the relative names and types of files (other than
+// directories) in a tree.
+func listTree(root string, ignore []string) (map[string]os.FileMode, error) {
+	files := make(map[string]os.FileMode)
+
+	err := filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+
+		for _, pattern := range ignore {
+			if ok, _ := path.Match(pattern, rel); ok {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+
+		if !info.IsDir() {
+			files[rel] = info.Mode().Type()
+		}
+		return nil
+	})
+
+	return files, err
+}
+
+func sameFile(a, b string, modeA, modeB os.FileMode) (bool, error) {
+	if modeA != modeB {
+		return false, nil
+	}
+
+	if modeA&os.ModeSymlink != 0 {
+		targetA, err := os.Readlink(a)
+		if err != nil {
+			return false, err
+		}
+		targetB, err := os.Readlink(b)
+		if err != nil {
+			return false, err
+		}
+		return targetA == targetB, nil
+	}
+
+	dataA, err := ioutil.ReadFile(a)
+	if err != nil {
+		return false, err
+	}
+	dataB, err := ioutil.ReadFile(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(dataA, dataB), nil
+}
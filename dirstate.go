@@ -0,0 +1,128 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+type dirState struct {
+	Newest  int64    `json:"newest"` // Modification time in nanoseconds.
+	Entries []string `json:"entries"`
+}
+
+func (a *dirState) equal(b *dirState) bool {
+	if a.Newest != b.Newest || len(a.Entries) != len(b.Entries) {
+		return false
+	}
+	for i := range a.Entries {
+		if a.Entries[i] != b.Entries[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// pendingDirStates are written at the end of a successful build.
+var pendingDirStates struct {
+	mu     sync.Mutex
+	states map[string]*dirState // Keyed by sidecar filename.
+}
+
+// DirChanged condition is true if the target doesn't exist, or if entries
+// have been added to, removed from or modified in the directory since the
+// last successful build.  Only the immediate entries of the directory are
+// considered.
+//
+// The state of the directory is stored in a sidecar file next to the target:
+// for example, the state for "bin/tool" is stored in "bin/.tool.dirstate".
+// The new state is recorded after the guarded tasks have been run
+// successfully, and written at the end of a successful build.
+func DirChanged(target, dir string) func() bool {
+	return func() bool {
+		sidecar := Join(Dir(target), "."+Base(target)+".dirstate")
+
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			logWarningf("%s directory %s: %v", target, dir, err)
+			return true
+		}
+
+		state := &dirState{Entries: []string{}}
+		for _, info := range infos {
+			state.Entries = append(state.Entries, info.Name())
+			if t := info.ModTime().UnixNano(); t > state.Newest {
+				state.Newest = t
+			}
+		}
+		sort.Strings(state.Entries)
+
+		var old dirState
+		changed := true
+		if data, err := ioutil.ReadFile(sidecar); err == nil {
+			if json.Unmarshal(data, &old) == nil {
+				changed = !old.equal(state)
+			}
+		}
+
+		if changed {
+			recordOnSuccess(func() {
+				pendingDirStates.mu.Lock()
+				defer pendingDirStates.mu.Unlock()
+
+				if pendingDirStates.states == nil {
+					pendingDirStates.states = make(map[string]*dirState)
+				}
+				pendingDirStates.states[sidecar] = state
+			})
+		}
+
+		return changed || !Exists(target)
+	}
+}
+
+func saveDirStates() error {
+	pendingDirStates.mu.Lock()
+	defer pendingDirStates.mu.Unlock()
+
+	for filename, state := range pendingDirStates.states {
+		data, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+
+		if err := writeFileAtomic(filename, data, 0644); err != nil {
+			return err
+		}
+
+		delete(pendingDirStates.states, filename)
+	}
+
+	return nil
+}
+
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(Dir(filename), "."+Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// GitChangedFiles returns a function which lists files which have been
+// changed since baseRef (committed, staged or unstaged), and untracked files.
+// Paths are relative to the current directory, and only files which exist are
+// included.  Empty list is returned if git fails (e.g. if not in a git
+// repository).
+func GitChangedFiles(baseRef string) func() []string {
+	return func() []string {
+		commands := [][]string{
+			{"git", "diff", "--name-only", "--relative", baseRef + "...HEAD"},
+			{"git", "diff", "--name-only", "--relative", "--cached"},
+			{"git", "diff", "--name-only", "--relative"},
+			{"git", "ls-files", "--others", "--exclude-standard"},
+		}
+
+		set := make(map[string]struct{})
+
+		for _, command := range commands {
+			output, err := exec.Command(command[0], command[1:]...).Output()
+			if err != nil {
+				return nil
+			}
+
+			for _, name := range strings.Split(string(output), "\n") {
+				if name != "" {
+					set[name] = struct{}{}
+				}
+			}
+		}
+
+		var names []string
+		for name := range set {
+			if Exists(name) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+}
+
+// OnGitBranch condition is true if the current git branch is one of the
+// names.  It is false if git fails or HEAD is detached.
+func OnGitBranch(names ...string) func() bool {
+	return func() bool {
+		output, err := exec.Command("git", "symbolic-ref", "--quiet", "--short", "HEAD").Output()
+		if err != nil {
+			return false
+		}
+		return containsString(names, strings.TrimSpace(string(output)))
+	}
+}
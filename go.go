@@ -0,0 +1,484 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GoFlags is called by Go to get the flags which are inserted after the go
+// subcommand.  By default they are read from the GOFLAGS variable (see
+// goVars).
+var GoFlags = func() []string {
+	return Fields(lookupVar("GOFLAGS", ""))
+}
+
+// goVars can be specified on the command-line even if the program doesn't
+// access them via Getvar.  They are read without a default value, so Getvar
+// may be called with any default value for them.
+var goVars = []string{"GOARCH", "GOFLAGS", "GOOS"}
+
+// Go command task.  The first argument (after flattening) is the go
+// subcommand, and GoFlags are inserted after it.  If the GOOS or GOARCH
+// variable (see goVars) is specified, it is set in the command's environment.
+func Go(args ...interface{}) Task {
+	return goEnv().Command("go", goArgs(Flatten(args)))
+}
+
+func goEnv() Env {
+	var env Env
+
+	for _, key := range []string{"GOOS", "GOARCH"} {
+		if value := lookupVar(key, ""); value != "" {
+			if env == nil {
+				env = make(Env)
+			}
+			env[key] = value
+		}
+	}
+
+	return env
+}
+
+// CrossEnv for building Go programs for another platform.
+func CrossEnv(goos, goarch string) Env {
+	return Env{
+		"GOOS":   goos,
+		"GOARCH": goarch,
+	}
+}
+
+// TargetOS returns the GOOS value of env.  If it's not set, the GOOS variable
+// (see goVars) or the host's GOOS is returned.
+func TargetOS(env Env) string {
+	if goos := env["GOOS"]; goos != "" {
+		return goos
+	}
+	if goos := lookupVar("GOOS", ""); goos != "" {
+		return goos
+	}
+	return GOOS
+}
+
+// TargetExeSuffix returns ".exe" if the target OS (see TargetOS) is Windows,
+// or empty string otherwise.
+func TargetExeSuffix(env Env) string {
+	if TargetOS(env) == "windows" {
+		return ".exe"
+	}
+	return ""
+}
+
+func goArgs(args []string) []string {
+	if len(args) == 0 {
+		return nil
+	}
+
+	return Flatten(args[0], GoFlags(), args[1:])
+}
+
+// Tags returns -tags flag arguments for go commands.  Empty strings are
+// skipped, so tags can be included conditionally.  Nil is returned if there
+// are no tags.
+func Tags(tags ...string) []string {
+	var list []string
+	for _, tag := range tags {
+		if tag != "" {
+			list = append(list, tag)
+		}
+	}
+	if len(list) == 0 {
+		return nil
+	}
+	return []string{"-tags", strings.Join(list, ",")}
+}
+
+// ModulePath reads the module path from go.mod in the current directory.
+// Empty string is returned if go.mod doesn't exist or doesn't declare a
+// module.
+func ModulePath() string {
+	data, err := ioutil.ReadFile("go.mod")
+	if err != nil {
+		return ""
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "module" {
+			if s, err := strconv.Unquote(fields[1]); err == nil {
+				return s
+			}
+			return fields[1]
+		}
+	}
+
+	return ""
+}
+
+var majorVersionSuffix = regexp.MustCompile(`^v[0-9]+$`)
+
+// ModuleName returns the last element of the module path (see ModulePath),
+// which is the default name of the module's main package binary.  Major
+// version suffix (such as /v2) is skipped like go build does.  Empty string
+// is returned if there is no module.
+func ModuleName() string {
+	p := ModulePath()
+	if p == "" {
+		return ""
+	}
+
+	name := path.Base(p)
+	if majorVersionSuffix.MatchString(name) {
+		if dir := path.Dir(p); dir != "." {
+			name = path.Base(dir)
+		}
+	}
+	return name
+}
+
+// GoTest task runs go test for each package matched by the patterns with
+// coverage profiling.  The profiles are merged into the profile file (unless
+// it is empty), and total statement coverage is printed.  The build fails if
+// the coverage percentage is below minCoverage.  Flags are passed to go test.
+func GoTest(patterns []string, profile string, minCoverage float64, flags ...interface{}) Task {
+	return Task{
+		custom: func(r *runner) error {
+			// Packages are listed with the same environment and flags as
+			// they are tested.
+			list, err := goEnv().Command("go", goArgs(Flatten("list", patterns))).cmd(r.ctx)
+			if err != nil {
+				return err
+			}
+			list.Stderr = os.Stderr
+
+			output, err := list.Output()
+			if err != nil {
+				return err
+			}
+
+			tempDir, err := ioutil.TempDir("", "gotest")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(tempDir)
+
+			var profiles []string
+
+			for i, pkg := range strings.Fields(string(output)) {
+				name := filepath.Join(tempDir, strconv.Itoa(i)+".out")
+				args := Flatten("test", "-coverprofile="+name, flags, pkg)
+
+				if _, err := r.run(goEnv().Command("go", goArgs(args))); err != nil {
+					return err
+				}
+
+				if Exists(name) {
+					profiles = append(profiles, name)
+				}
+			}
+
+			cov, err := mergeCoverProfiles(profile, profiles)
+			if err != nil {
+				return err
+			}
+
+			percent := 100.0
+			if cov.statements > 0 {
+				percent = 100 * float64(cov.covered) / float64(cov.statements)
+			}
+
+			logInfo("Coverage", fmt.Sprintf("%.1f%%", percent))
+
+			if percent < minCoverage {
+				return fmt.Errorf("coverage %.1f%% is below minimum %.1f%%", percent, minCoverage)
+			}
+			return nil
+		},
+		tag: new(tag),
+	}
+}
+
+type coverage struct {
+	statements int
+	covered    int
+}
+
+// mergeCoverProfiles combines the blocks of the profiles and writes them to
+// dest (unless it is empty).  Counts of duplicate blocks are summed, or
+// or'ed in set mode.
+func mergeCoverProfiles(dest string, profiles []string) (cov coverage, err error) {
+	var (
+		mode   string
+		blocks []string // Keys in order of appearance.
+		counts = make(map[string]int)
+		stmts  = make(map[string]int)
+	)
+
+	for _, name := range profiles {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return cov, err
+		}
+
+		for i, line := range strings.Split(string(data), "\n") {
+			if i == 0 {
+				m := strings.TrimPrefix(line, "mode: ")
+				if m == line {
+					return cov, fmt.Errorf("%s: missing mode line", name)
+				}
+				if mode != "" && m != mode {
+					return cov, fmt.Errorf("%s: mode %s differs from %s", name, m, mode)
+				}
+				mode = m
+				continue
+			}
+
+			// Format: name.go:line.column,line.column numberOfStatements count
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			if len(fields) != 3 {
+				return cov, fmt.Errorf("%s:%d: malformed line", name, i+1)
+			}
+
+			n, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return cov, fmt.Errorf("%s:%d: %v", name, i+1, err)
+			}
+			count, err := strconv.Atoi(fields[2])
+			if err != nil {
+				return cov, fmt.Errorf("%s:%d: %v", name, i+1, err)
+			}
+
+			key := fields[0]
+			if _, found := counts[key]; !found {
+				blocks = append(blocks, key)
+				stmts[key] = n
+				counts[key] = 0
+			}
+
+			if mode == "set" {
+				if count > 0 {
+					counts[key] = 1
+				}
+			} else {
+				counts[key] += count
+			}
+		}
+	}
+
+	var b strings.Builder
+
+	if mode != "" {
+		fmt.Fprintf(&b, "mode: %s\n", mode)
+	}
+
+	for _, key := range blocks {
+		fmt.Fprintf(&b, "%s %d %d\n", key, stmts[key], counts[key])
+
+		cov.statements += stmts[key]
+		if counts[key] > 0 {
+			cov.covered += stmts[key]
+		}
+	}
+
+	if dest != "" {
+		if err := InstallData(dest, strings.NewReader(b.String()), false); err != nil {
+			return cov, err
+		}
+	}
+
+	return cov, nil
+}
+
+var (
+	goGenerateDirective = regexp.MustCompile(`(?m)^//go:generate `)
+	goGeneratedComment  = regexp.MustCompile(`(?m)^// Code generated .* DO NOT EDIT\.$`)
+)
+
+// GoGenerate task runs go generate for each package (matched by the patterns)
+// which contains go:generate directives, if the package is outdated.  Go
+// files with the standard "Code generated ... DO NOT EDIT." comment are
+// considered outputs, and the other files in the package directory are
+// considered inputs.  A package is outdated if it has no outputs, or if an
+// input has been modified after an output.  The outputs are touched after
+// generation.
+func GoGenerate(packages ...string) Task {
+	return Task{
+		dynamic: func() ([]Task, error) {
+			output, err := RunIO(nil, Flatten("go", "list", "-f", "{{.Dir}}", packages)...)
+			if err != nil {
+				return nil, err
+			}
+
+			var tasks []Task
+
+			for _, dir := range strings.Fields(string(output)) {
+				inputs, outputs, hasDirectives, err := goGenerateFiles(dir)
+				if err != nil {
+					return nil, err
+				}
+				if !hasDirectives || !goGenerateOutdated(inputs, outputs) {
+					continue
+				}
+
+				dir := dir
+				tasks = append(tasks,
+					goEnv().Command("go", goArgs([]string{"generate", dir})),
+					Func(func() error {
+						_, outputs, _, err := goGenerateFiles(dir)
+						if err != nil {
+							return err
+						}
+
+						now := time.Now()
+						for _, name := range outputs {
+							if err := os.Chtimes(name, now, now); err != nil {
+								return err
+							}
+						}
+						return nil
+					}),
+				)
+			}
+
+			return tasks, nil
+		},
+		tag: new(tag),
+	}
+}
+
+// goGenerateFiles classifies the regular files of a package directory.
+func goGenerateFiles(dir string) (inputs, outputs []string, hasDirectives bool, err error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		name := filepath.Join(dir, info.Name())
+
+		if strings.HasSuffix(name, ".go") {
+			var src []byte
+			if src, err = ioutil.ReadFile(name); err != nil {
+				return
+			}
+
+			if goGeneratedComment.Match(src) {
+				outputs = append(outputs, name)
+				continue
+			}
+
+			if goGenerateDirective.Match(src) {
+				hasDirectives = true
+			}
+		}
+
+		inputs = append(inputs, name)
+	}
+
+	return
+}
+
+func goGenerateOutdated(inputs, outputs []string) bool {
+	if len(outputs) == 0 {
+		return true
+	}
+
+	var oldest time.Time
+	for i, name := range outputs {
+		info, err := os.Stat(name)
+		if err != nil {
+			return true
+		}
+		if t := info.ModTime(); i == 0 || t.Before(oldest) {
+			oldest = t
+		}
+	}
+
+	for _, name := range append(append([]string(nil), globalDeps...), inputs...) {
+		info, err := os.Stat(name)
+		if err != nil || info.ModTime().After(oldest) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GoFormat task formats Go source files in place (like gofmt -w).  The names
+// of modified files are printed.
+func GoFormat(paths func() []string) Task {
+	return Func(func() error {
+		return goFormat(paths(), true)
+	})
+}
+
+// GoFormatCheck task fails if some of the Go source files are not formatted
+// (like gofmt -l).  The names of the unformatted files are printed.
+func GoFormatCheck(paths func() []string) Task {
+	return Func(func() error {
+		return goFormat(paths(), false)
+	})
+}
+
+func goFormat(filenames []string, write bool) error {
+	var unformatted []string
+
+	for _, filename := range filenames {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+
+		src, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+
+		res, err := format.Source(src)
+		if err != nil {
+			return fmt.Errorf("%s: %v", filename, err)
+		}
+
+		if bytes.Equal(src, res) {
+			continue
+		}
+
+		if write {
+			logInfo("Formatting", filename)
+			if err := ioutil.WriteFile(filename, res, info.Mode().Perm()); err != nil {
+				return err
+			}
+		} else {
+			logError("Not formatted:", filename)
+			unformatted = append(unformatted, filename)
+		}
+	}
+
+	if len(unformatted) > 0 {
+		return fmt.Errorf("%d Go source file(s) not formatted", len(unformatted))
+	}
+	return nil
+}
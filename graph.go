@@ -0,0 +1,123 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"fmt"
+	"strings"
+)
+
+// rule declares the inputs and output of a Rule task.
+type rule struct {
+	target  string
+	sources func() []string
+}
+
+// Graph task runs the tasks in dependency order.  Tasks created with Rule
+// declare their target and sources; a rule whose target is a source of
+// another rule is run before it.  Other tasks are run in the order in which
+// they are specified, subject to the dependencies.  Sources are evaluated
+// before any of the tasks are run, so they should be listed explicitly
+// instead of globbing for files which are generated.  Dependency cycles
+// cause the build to fail.
+//
+// This is experimental.
+func Graph(tasks ...Task) Task {
+	return Task{
+		dynamic: func() ([]Task, error) {
+			order, err := sortGraph(tasks)
+			if err != nil {
+				return nil, err
+			}
+
+			sorted := make([]Task, 0, len(tasks))
+			for _, i := range order {
+				sorted = append(sorted, tasks[i])
+			}
+			return sorted, nil
+		},
+		tag: new(tag),
+	}
+}
+
+// sortGraph returns task indexes in topological order.
+func sortGraph(tasks []Task) ([]int, error) {
+	producers := make(map[string]int)
+	for i, task := range tasks {
+		if task.rule != nil {
+			if j, found := producers[task.rule.target]; found {
+				return nil, fmt.Errorf("targets of tasks %d and %d are both %s", j, i, task.rule.target)
+			}
+			producers[task.rule.target] = i
+		}
+	}
+
+	deps := make([][]int, len(tasks))
+	for i, task := range tasks {
+		if task.rule != nil && task.rule.sources != nil {
+			for _, source := range task.rule.sources() {
+				if j, found := producers[source]; found {
+					deps[i] = append(deps[i], j)
+				}
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	var (
+		state = make([]int, len(tasks))
+		path  []int
+		order []int
+		visit func(i int) error
+	)
+
+	visit = func(i int) error {
+		switch state[i] {
+		case visited:
+			return nil
+
+		case visiting:
+			var names []string
+			for k := len(path) - 1; k >= 0; k-- {
+				names = append(names, tasks[path[k]].rule.target)
+				if path[k] == i {
+					break
+				}
+			}
+			for l, r := 0, len(names)-1; l < r; l, r = l+1, r-1 {
+				names[l], names[r] = names[r], names[l]
+			}
+			names = append(names, tasks[i].rule.target)
+			return fmt.Errorf("dependency cycle: %s", strings.Join(names, " -> "))
+		}
+
+		state[i] = visiting
+		path = append(path, i)
+
+		for _, j := range deps[i] {
+			if err := visit(j); err != nil {
+				return err
+			}
+		}
+
+		path = path[:len(path)-1]
+		state[i] = visited
+		order = append(order, i)
+		return nil
+	}
+
+	for i := range tasks {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
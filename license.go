@@ -0,0 +1,169 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var commentPrefixes = map[string]string{
+	".c":     "//",
+	".cc":    "//",
+	".cpp":   "//",
+	".go":    "//",
+	".h":     "//",
+	".hpp":   "//",
+	".java":  "//",
+	".js":    "//",
+	".kt":    "//",
+	".proto": "//",
+	".rs":    "//",
+	".swift": "//",
+	".ts":    "//",
+	".bash":  "#",
+	".mk":    "#",
+	".pl":    "#",
+	".py":    "#",
+	".rb":    "#",
+	".sh":    "#",
+	".toml":  "#",
+	".yaml":  "#",
+	".yml":   "#",
+	".lua":   "--",
+	".sql":   "--",
+}
+
+// LicenseHeader task checks that the files begin with a header.  The header
+// is commented using line comments according to the filename extension,
+// unless it is already commented.  A shebang line and Go build constraints
+// may precede the header.  Files may have LF or CRLF line endings.  If fix is
+// true, the header is inserted into files which lack it; otherwise the build
+// fails listing the files.
+func LicenseHeader(header string, files func() []string, fix bool) Task {
+	return Func(func() error {
+		var missing []string
+
+		for _, filename := range files() {
+			prefix, found := commentPrefixes[filepath.Ext(filename)]
+			if !found {
+				return fmt.Errorf("%s: unknown comment syntax", filename)
+			}
+
+			info, err := os.Stat(filename)
+			if err != nil {
+				return err
+			}
+
+			data, err := ioutil.ReadFile(filename)
+			if err != nil {
+				return err
+			}
+			content := string(data)
+
+			// Line endings are converted back when writing.
+			crlf := strings.Contains(content, "\r\n")
+			if crlf {
+				content = strings.Replace(content, "\r\n", "\n", -1)
+			}
+
+			comment := commentHeader(header, prefix)
+			offset := headerOffset(content)
+			if strings.HasPrefix(content[offset:], comment) {
+				continue
+			}
+
+			if !fix {
+				logError("Missing license header:", filename)
+				missing = append(missing, filename)
+				continue
+			}
+
+			logInfo("Adding license header to", filename)
+
+			rest := content[offset:]
+			if rest != "" && !strings.HasPrefix(rest, "\n") {
+				comment += "\n"
+			}
+			content = content[:offset] + comment + rest
+			if crlf {
+				content = strings.Replace(content, "\n", "\r\n", -1)
+			}
+
+			if err := ioutil.WriteFile(filename, []byte(content), info.Mode().Perm()); err != nil {
+				return err
+			}
+		}
+
+		if len(missing) > 0 {
+			return fmt.Errorf("%d file(s) without license header", len(missing))
+		}
+		return nil
+	})
+}
+
+// commentHeader converts header text to line comments, unless it already
+// consists of them.  The result ends with newline.
+func commentHeader(header, prefix string) string {
+	lines := strings.Split(strings.TrimRight(header, "\n"), "\n")
+
+	commented := true
+	for _, line := range lines {
+		if !strings.HasPrefix(line, prefix) {
+			commented = false
+			break
+		}
+	}
+
+	var b strings.Builder
+	for _, line := range lines {
+		switch {
+		case commented:
+			b.WriteString(line)
+		case line == "":
+			b.WriteString(prefix)
+		default:
+			b.WriteString(prefix + " " + line)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// headerOffset skips a shebang line and Go build constraints (including the
+// blank line after them).
+func headerOffset(content string) int {
+	offset := 0
+
+	if strings.HasPrefix(content, "#!") {
+		offset = lineEnd(content, offset)
+	}
+
+	constraints := false
+	for {
+		rest := content[offset:]
+		if !strings.HasPrefix(rest, "//go:build") && !strings.HasPrefix(rest, "// +build") {
+			break
+		}
+		offset = lineEnd(content, offset)
+		constraints = true
+	}
+
+	if constraints && strings.HasPrefix(content[offset:], "\n") {
+		offset++
+	}
+
+	return offset
+}
+
+func lineEnd(s string, offset int) int {
+	if i := strings.IndexByte(s[offset:], '\n'); i >= 0 {
+		return offset + i + 1
+	}
+	return len(s)
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLicenseHeaderCRLF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "make-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "test.go")
+	if err := ioutil.WriteFile(filename, []byte("//go:build linux\r\n\r\npackage test\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files := func() []string { return []string{filename} }
+	expected := "//go:build linux\r\n\r\n// Header\r\n// text.\r\n\r\npackage test\r\n"
+
+	for i, fix := range []bool{true, true, false} {
+		if _, err := newRunner(context.Background()).run(LicenseHeader("Header\ntext.\n", files, fix)); err != nil {
+			t.Fatalf("run %d: %v", i, err)
+		}
+
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := string(data); s != expected {
+			t.Fatalf("run %d: file contents: %q, expected %q", i, s, expected)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// EnsureLine task appends a line to a file unless the file already contains
+// it.  The file is created if it doesn't exist.  A newline is added before
+// the line if the file doesn't end with one, and CRLF line endings are used if
+// the file uses them.  Nothing is done if the line exists.
+func EnsureLine(file, line string) Task {
+	var data []byte
+
+	missing := func() (bool, error) {
+		var err error
+		data, err = ioutil.ReadFile(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return true, nil
+			}
+			return false, err
+		}
+
+		for _, l := range strings.Split(string(data), "\n") {
+			if strings.TrimSuffix(l, "\r") == line {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+
+	return IfErr(missing, actionFunc("add line to "+file, func() error {
+		logInfo("Adding line to", file)
+
+		newline := "\n"
+		if bytes.Contains(data, []byte("\r\n")) {
+			newline = "\r\n"
+		}
+
+		var b strings.Builder
+		if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+			b.WriteString(newline)
+		}
+		b.WriteString(line)
+		b.WriteString(newline)
+
+		if err := mkdirAll(Dir(file)); err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if _, err := f.WriteString(b.String()); err != nil {
+			return err
+		}
+		return f.Close()
+	}))
+}
@@ -0,0 +1,17 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package make
+
+import (
+	"os"
+)
+
+// lockBuild is a no-op on this platform.
+func lockBuild(filename string) (*os.File, error) {
+	return nil, nil
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Log levels passed to the function set with SetLogger.
+const (
+	LevelInfo    = "info"
+	LevelWarning = "warning"
+	LevelError   = "error"
+)
+
+var (
+	logger    func(level, msg string)
+	syslogger func(level, msg string) // Used in addition to the others.
+)
+
+// logMu serializes messages, which may be logged by concurrent installations.
+var logMu sync.Mutex
+
+// SetLogger routes the messages printed by this package (such as "Running" and
+// "Installing" lines, warnings and errors) to a function instead of stdout
+// and stderr.  Output of commands is not affected.  nil restores the default
+// behavior.  The function is not called concurrently.
+func SetLogger(f func(level, msg string)) {
+	logger = f
+}
+
+func logMessage(level, msg string) {
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	if syslogger != nil {
+		syslogger(level, msg)
+	}
+
+	switch {
+	case logger != nil:
+		logger(level, msg)
+
+	case level == LevelInfo:
+		_, err := fmt.Println(msg)
+		checkBrokenPipe(err)
+
+	default:
+		fmt.Fprintln(os.Stderr, msg)
+	}
+}
+
+// logInfo message consisting of Flatten'ed, space-separated strings.
+func logInfo(strs ...interface{}) {
+	logMessage(LevelInfo, strings.Join(Flatten(strs), " "))
+}
+
+func logWarningf(format string, args ...interface{}) {
+	logMessage(LevelWarning, fmt.Sprintf(format, args...))
+}
+
+// logError message consisting of space-separated operands (like fmt.Println).
+func logError(args ...interface{}) {
+	logMessage(LevelError, strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
+}
@@ -6,6 +6,11 @@
 package make
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -13,10 +18,15 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 const (
@@ -27,7 +37,8 @@ const (
 // Println prints space-separated strings and a newline.  The arguments will be
 // Flatten'ed.
 func Println(strs ...interface{}) {
-	fmt.Println(strings.Join(Flatten(strs), " "))
+	_, err := fmt.Println(strings.Join(Flatten(strs), " "))
+	checkBrokenPipe(err)
 }
 
 // Getenv is like os.Getenv(), with default value support.
@@ -41,7 +52,7 @@ func Getenv(key, defaultValue string) string {
 // Setenv is like os.Setenv(), but program is terminated on error.
 func Setenv(key, value string) {
 	if err := os.Setenv(key, value); err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		logError(err)
 		os.Exit(1)
 	}
 }
@@ -61,15 +72,49 @@ func Join(elem ...string) string {
 	return path.Join(elem...)
 }
 
+// CleanPath is filepath.Clean().
+func CleanPath(p string) string {
+	return filepath.Clean(p)
+}
+
+// IsSubpath checks if p is base or located under it (lexically, without
+// resolving symbolic links).  Both must be absolute or both relative.
+func IsSubpath(base, p string) bool {
+	rel, err := filepath.Rel(filepath.Clean(base), filepath.Clean(p))
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
 // Fields is strings.Fields().
 func Fields(s string) []string {
 	return strings.Fields(s)
 }
 
-// Exists path?
+// Exists path?  A path which cannot be checked due to an unexpected error (such
+// as permission denied) is reported as existing; use ExistsErr to distinguish
+// such cases.
 func Exists(path string) bool {
+	exists, err := ExistsErr(path)
+	return exists || err != nil
+}
+
+// ExistsErr checks if path exists.  False is returned without error if path
+// or one of its parent directories doesn't exist, or if a parent is not a
+// directory.  Other errors (such as permission denied) are returned.
+func ExistsErr(path string) (bool, error) {
 	_, err := os.Stat(path)
-	return err == nil || !os.IsNotExist(err)
+	switch {
+	case err == nil:
+		return true, nil
+
+	case os.IsNotExist(err), errors.Is(err, syscall.ENOTDIR):
+		return false, nil
+
+	default:
+		return false, err
+	}
 }
 
 // LookPath is like exec.LookPath(), but the first argument that is found is
@@ -92,7 +137,7 @@ func Glob(patterns ...string) []string {
 	for _, pat := range patterns {
 		matches, err := filepath.Glob(pat)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
+			logError(err)
 			os.Exit(1)
 		}
 
@@ -102,6 +147,52 @@ func Glob(patterns ...string) []string {
 	return results
 }
 
+// ReadFile contents with leading and trailing whitespace removed.  Terminates
+// program on error.
+func ReadFile(path string) string {
+	s, err := ReadFileErr(path)
+	if err != nil {
+		logError(err)
+		os.Exit(1)
+	}
+	return s
+}
+
+// ReadFileErr contents with leading and trailing whitespace removed.
+func ReadFileErr(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// GlobFiles is like Glob, but only regular files (or symbolic links to them)
+// are included.
+func GlobFiles(patterns ...string) []string {
+	return globMode(patterns, func(mode os.FileMode) bool {
+		return mode.IsRegular()
+	})
+}
+
+// GlobDirs is like Glob, but only directories (or symbolic links to them) are
+// included.
+func GlobDirs(patterns ...string) []string {
+	return globMode(patterns, os.FileMode.IsDir)
+}
+
+func globMode(patterns []string, match func(os.FileMode) bool) []string {
+	var results []string
+
+	for _, name := range Glob(patterns...) {
+		if info, err := os.Stat(name); err == nil && match(info.Mode()) {
+			results = append(results, name)
+		}
+	}
+
+	return results
+}
+
 // Globber returns a function which globs or terminates program on error.
 // Results of multiple pattern will be concatenated.
 func Globber(patterns ...string) func() []string {
@@ -110,16 +201,85 @@ func Globber(patterns ...string) func() []string {
 	}
 }
 
-// Touch file.  Directories are created as needed.
+// StdinLines reads lines from standard input, trims surrounding whitespace and
+// skips empty lines.  If standard input is a terminal, nil is returned without
+// reading (so that the program doesn't block waiting for user input).  The
+// program is terminated on read error.
+func StdinLines() []string {
+	if isTerminal(os.Stdin) {
+		return nil
+	}
+
+	var lines []string
+
+	s := bufio.NewScanner(os.Stdin)
+	for s.Scan() {
+		if line := strings.TrimSpace(s.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := s.Err(); err != nil {
+		logError(err)
+		os.Exit(1)
+	}
+
+	return lines
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Touch file.  Directories are created as needed.  New files get mode 0644
+// and new directories 0755 regardless of umask.
 func Touch(filename string) error {
-	os.MkdirAll(path.Dir(filename), 0777)
+	mkdirAll(path.Dir(filename))
+	created := !Exists(filename)
 	f, err := os.Create(filename)
 	if err != nil {
 		return err
 	}
+	if created {
+		if err := f.Chmod(0644); err != nil {
+			f.Close()
+			return err
+		}
+	}
 	return f.Close()
 }
 
+// createFile creates or truncates a file.  Directories are created as needed.
+func createFile(filename string) (*os.File, error) {
+	if err := mkdirAll(Dir(filename)); err != nil {
+		return nil, err
+	}
+	return os.Create(filename)
+}
+
+// mkdirAll is like os.MkdirAll, but the created directories get mode 0755
+// regardless of umask.
+func mkdirAll(dirpath string) error {
+	var created []string
+	for dir := filepath.Clean(dirpath); !Exists(dir); dir = filepath.Dir(dir) {
+		created = append(created, dir)
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+
+	if err := os.MkdirAll(dirpath, 0755); err != nil {
+		return err
+	}
+
+	for _, dir := range created {
+		if err := os.Chmod(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // ReplaceSuffix replaces the dot-separated suffix of the filename part of a
 // path, or panics.
 func ReplaceSuffix(s, newSuffix string) string {
@@ -132,7 +292,7 @@ func ReplaceSuffix(s, newSuffix string) string {
 
 // Run command.
 func Run(command ...string) error {
-	Println("Running", command)
+	logInfo("Running", command)
 	cmd := exec.Command(command[0], command[1:]...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -147,16 +307,71 @@ func RunIO(input io.Reader, command ...string) (output []byte, err error) {
 	return cmd.Output()
 }
 
-// Vars specified on the command-line.
+// Vars specified on the command-line.  It must not be modified while tasks
+// are running.
 var Vars = make(map[string]string)
 var varDefaults = make(map[string]string)
 
-// Getvar specified on the command-line.
+// varsMu guards Vars, varDefaults and varsComputing.
+var varsMu sync.Mutex
+
+// Getvar specified on the command-line.  It is safe to call concurrently.
 func Getvar(key, defaultValue string) string {
+	registerVar(key, defaultValue)
+	return lookupVar(key, defaultValue)
+}
+
+// VarThunk returns a function which returns the value of a variable in a
+// slice.  The variable is registered immediately (like Getvar), but its value
+// is resolved when the function is called.
+func VarThunk(key, defaultValue string) func() []string {
+	registerVar(key, defaultValue)
+
+	return func() []string {
+		return []string{lookupVar(key, defaultValue)}
+	}
+}
+
+// varsComputing holds the keys whose defaults are being computed by
+// GetvarFunc.
+var varsComputing = make(map[string]struct{})
+
+// GetvarFunc is like Getvar, but the default value is computed by calling
+// defaultFn, which may use other variables.  Referring to the variable itself
+// (directly or indirectly) causes a panic.  The same variable must not be
+// accessed concurrently using GetvarFunc.
+func GetvarFunc(key string, defaultFn func() string) string {
+	varsMu.Lock()
+	_, busy := varsComputing[key]
+	varsComputing[key] = struct{}{}
+	varsMu.Unlock()
+
+	if busy {
+		panic(fmt.Sprintf("Variable %s default value refers to itself", key))
+	}
+
+	defaultValue := defaultFn()
+
+	varsMu.Lock()
+	delete(varsComputing, key)
+	varsMu.Unlock()
+
+	return Getvar(key, defaultValue)
+}
+
+func registerVar(key, defaultValue string) {
+	varsMu.Lock()
+	defer varsMu.Unlock()
+
 	if value, exist := varDefaults[key]; exist && value != defaultValue {
 		panic(fmt.Sprintf("Variable %s accessed with different default values", key))
 	}
 	varDefaults[key] = defaultValue
+}
+
+func lookupVar(key, defaultValue string) string {
+	varsMu.Lock()
+	defer varsMu.Unlock()
 
 	if value, ok := Vars[key]; ok {
 		return value
@@ -164,10 +379,49 @@ func Getvar(key, defaultValue string) string {
 	return defaultValue
 }
 
+// varValues returns the values of the registered variables.
+func varValues() map[string]string {
+	varsMu.Lock()
+	defer varsMu.Unlock()
+
+	values := make(map[string]string, len(varDefaults))
+	for key, value := range varDefaults {
+		if v, found := Vars[key]; found {
+			value = v
+		}
+		values[key] = value
+	}
+	return values
+}
+
+func setVar(key, value string) {
+	varsMu.Lock()
+	defer varsMu.Unlock()
+
+	Vars[key] = value
+}
+
+func varRegistered(key string) bool {
+	varsMu.Lock()
+	defer varsMu.Unlock()
+
+	if _, found := varDefaults[key]; found {
+		return true
+	}
+	for _, name := range goVars {
+		if key == name {
+			return true
+		}
+	}
+	return false
+}
+
 // Flatten strings and string slices into single string slice.  Flatten("foo",
-// []string{"bar", "baz"}) returns []string{"foo", "bar", "baz"}.  Flatten will
-// panic if called with a type that is not string, []string, func() []string or
-// []interface{}.
+// []string{"bar", "baz"}) returns []string{"foo", "bar", "baz"}.  Functions are
+// called and their results are flattened recursively.  Maps are expanded to
+// key=value strings sorted by key.  Flatten will panic if called with a type
+// that is not string, []string, func() []string, map[string]string, Env,
+// []interface{}, func() interface{} or func() []interface{}.
 func Flatten(strings ...interface{}) []string {
 	return flatten(nil, strings)
 }
@@ -196,9 +450,21 @@ func flatten(dest []string, strings []interface{}) []string {
 				dest = append(dest, s)
 			}
 
+		case map[string]string:
+			dest = appendPairs(dest, x)
+
+		case Env:
+			dest = appendPairs(dest, x)
+
 		case []interface{}:
 			dest = flatten(dest, x)
 
+		case func() interface{}:
+			dest = flatten(dest, []interface{}{x()})
+
+		case func() []interface{}:
+			dest = flatten(dest, x())
+
 		default:
 			panic(x)
 		}
@@ -207,6 +473,19 @@ func flatten(dest []string, strings []interface{}) []string {
 	return dest
 }
 
+func appendPairs(dest []string, m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		dest = append(dest, k+"="+m[k])
+	}
+	return dest
+}
+
 // Flattener is a lazy version of Flatten.
 func Flattener(strings ...interface{}) func() []string {
 	return func() []string {
@@ -243,6 +522,73 @@ func CommandWrap(optionalWrapper string, command ...interface{}) Task {
 	return Env(nil).CommandWrap(optionalWrapper, command...)
 }
 
+// CommandEnvFunc task.  The environment variables are determined by calling
+// envFunc when the task is run.
+func CommandEnvFunc(envFunc func() Env, command ...interface{}) Task {
+	return Task{
+		command: Flatten(command),
+		envFunc: envFunc,
+		tag:     new(tag),
+	}
+}
+
+// CommandAllowExit task treats the listed nonzero exit codes as success.
+func CommandAllowExit(codes []int, command ...interface{}) Task {
+	return Env(nil).CommandAllowExit(codes, command...)
+}
+
+// CommandExitCode task stores the exit code of the command in *dest instead of
+// failing the build.
+func CommandExitCode(dest *int, command ...interface{}) Task {
+	return Env(nil).CommandExitCode(dest, command...)
+}
+
+// CommandStderr task writes the standard error output of the command to a
+// file.
+func CommandStderr(filename string, command ...interface{}) Task {
+	return Env(nil).CommandStderr(filename, command...)
+}
+
+// Script task runs the commands in order in a directory (see Env.Script).
+func Script(dir string, commands ...[]interface{}) Task {
+	return Env(nil).Script(dir, commands...)
+}
+
+// CommandLimits task runs the command with resource limits (see
+// Env.CommandLimits).
+func CommandLimits(mem int64, cpuSec int, command ...interface{}) Task {
+	return Env(nil).CommandLimits(mem, cpuSec, command...)
+}
+
+// CommandUser task runs the command as another user (see Env.CommandUser).
+func CommandUser(uid, gid int, command ...interface{}) Task {
+	return Env(nil).CommandUser(uid, gid, command...)
+}
+
+// CommandPTY task runs the command with a pseudo-terminal (see
+// Env.CommandPTY).
+func CommandPTY(command ...interface{}) Task {
+	return Env(nil).CommandPTY(command...)
+}
+
+// CommandResultTo task stores the outcome of the command in *res (see
+// Env.CommandResult).
+func CommandResultTo(res *CommandResult, command ...interface{}) Task {
+	return Env(nil).CommandResult(res, command...)
+}
+
+// CommandExpect task fails if the output of the command is not the expected
+// string (see Env.CommandExpect).
+func CommandExpect(expected string, command ...interface{}) Task {
+	return Env(nil).CommandExpect(expected, command...)
+}
+
+// CommandMatch task fails if the output of the command doesn't match the
+// regular expression (see Env.CommandMatch).
+func CommandMatch(pattern string, command ...interface{}) Task {
+	return Env(nil).CommandMatch(pattern, command...)
+}
+
 // System task.
 func System(commandline string) Task {
 	return Env(nil).System(commandline)
@@ -256,13 +602,77 @@ func Func(f func() error) Task {
 	}
 }
 
+// actionFunc task is a function task which describes its action for
+// diagnostics and plans.
+func actionFunc(action string, f func() error) Task {
+	return Task{
+		function: f,
+		action:   action,
+		tag:      new(tag),
+	}
+}
+
+// ErrStop can be returned by a function task to stop the innermost enclosing
+// target without running its remaining tasks.  The target is considered
+// successful, and the tasks of its parent targets continue normally.
+var ErrStop = errors.New("stop")
+
+// NamedFunc task is like Func, but the name is printed when the function is
+// run, and included in its error.
+func NamedFunc(name string, f func() error) Task {
+	return Task{
+		function: f,
+		desc:     name,
+		tag:      new(tag),
+	}
+}
+
+// Echo task prints space-separated strings and a newline.  The arguments will
+// be Flatten'ed.  Nothing is printed if the --quiet option is specified.
+func Echo(strs ...interface{}) Task {
+	return Func(func() error {
+		if !quiet {
+			logInfo(strs...)
+		}
+		return nil
+	})
+}
+
+// Fail task returns a formatted error, which fails the build.  With the
+// --keep-going option, the failure is recorded and other targets are run
+// before the build fails.
+func Fail(format string, args ...interface{}) Task {
+	return Func(func() error {
+		return fmt.Errorf(format, args...)
+	})
+}
+
 // If task.
 func If(cond func() bool, tasks ...Task) Task {
+	return IfErr(NoErr(cond), tasks...)
+}
+
+// IfErr task.  The build fails if the condition returns an error.
+func IfErr(cond CondErr, tasks ...Task) Task {
 	return Task{
 		tasks: tasks,
-		cond:  cond,
+		conds: []CondErr{cond},
+		tag:   new(tag),
+	}
+}
+
+// IfAll task runs the tasks if all conditions are true.  The conditions are
+// evaluated in order until one of them is false.  With the --why option, the
+// false condition is reported.
+func IfAll(conds []func() bool, tasks ...Task) Task {
+	task := Task{
+		tasks: tasks,
 		tag:   new(tag),
 	}
+	for _, cond := range conds {
+		task.conds = append(task.conds, NoErr(cond))
+	}
+	return task
 }
 
 // Group tasks.
@@ -273,10 +683,27 @@ func Group(tasks ...Task) Task {
 	}
 }
 
-// Directory creation task.
+// ForEach task calls fn for each item and runs the returned tasks.  The items
+// are listed when the task is run, so they may include files which are
+// created by previous tasks.
+func ForEach(items func() []string, fn func(item string) Task) Task {
+	return Task{
+		dynamic: func() ([]Task, error) {
+			var tasks []Task
+			for _, item := range items() {
+				tasks = append(tasks, fn(item))
+			}
+			return tasks, nil
+		},
+		tag: new(tag),
+	}
+}
+
+// Directory creation task.  New directories get mode 0755 regardless of
+// umask.
 func Directory(dirpath string) Task {
-	return Func(func() error {
-		return os.MkdirAll(dirpath, 0777)
+	return actionFunc("create directory "+dirpath, func() error {
+		return mkdirAll(dirpath)
 	})
 }
 
@@ -288,7 +715,7 @@ func DirectoryOf(filename string) Task {
 // Removal task.  Tries to os.RemoveAll the directory trees, and returns the
 // first error.
 func Removal(directories ...string) Task {
-	return Func(func() (err error) {
+	return actionFunc("remove "+strings.Join(directories, " "), func() (err error) {
 		for _, path := range directories {
 			if e := os.RemoveAll(path); err == nil {
 				err = e
@@ -298,322 +725,1920 @@ func Removal(directories ...string) Task {
 	})
 }
 
-// Installation task.
-func Installation(destName, sourceName string, executable bool) Task {
-	return Func(func() error {
-		return Install(destName, sourceName, executable)
+// Move task renames a file, replacing existing destination.  The destination
+// directory is created if needed.  If the file cannot be renamed across
+// filesystems, it is copied and the source is removed.  Permissions are
+// preserved.
+func Move(dest, src string) Task {
+	return actionFunc("move "+src+" to "+dest, func() error {
+		if err := moveFile(dest, src); err != nil {
+			return fmt.Errorf("moving %s to %s: %w", src, dest, err)
+		}
+		recordOutput(dest)
+		return nil
 	})
 }
 
-// Install file.
-func Install(destination, sourceName string, executable bool) error {
-	destName := destination
-	if strings.HasSuffix(destName, "/") {
-		destName = Join(destName, Base(sourceName))
-	}
-
-	source, err := os.Open(sourceName)
+func moveFile(dest, src string) error {
+	info, err := os.Stat(src)
 	if err != nil {
 		return err
 	}
-	defer source.Close()
-
-	return InstallData(destName, source, executable)
-}
-
-// InstallData file.
-func InstallData(destName string, source io.Reader, executable bool) error {
-	Println("Installing", destName)
 
-	dir := Dir(destName)
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	if err := mkdirAll(Dir(dest)); err != nil {
 		return err
 	}
 
-	temp := Base(destName) + ".*"
-	if !strings.HasPrefix(temp, ".") {
-		temp = "." + temp
+	err = os.Rename(src, dest)
+	if err == nil || !isCrossDevice(err) {
+		return err
 	}
 
-	var (
-		ok     bool
-		closed bool
-	)
+	return copyCrossDevice(dest, src, info.Mode().Perm())
+}
 
-	dest, err := ioutil.TempFile(dir, temp)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if !ok {
-			os.Remove(dest.Name())
-		}
-		if !closed {
-			dest.Close()
+// Symlink task creates or replaces a symbolic link.  The link's directory is
+// created if needed.
+func Symlink(linkPath, target string) Task {
+	return actionFunc("link "+linkPath+" to "+target, func() error {
+		logInfo("Linking", linkPath, "->", target)
+		if err := symlinkAtomic(target, linkPath); err != nil {
+			return err
 		}
-	}()
+		recordOutput(linkPath)
+		return nil
+	})
+}
 
-	if _, err := io.Copy(dest, source); err != nil {
-		return err
-	}
+// SymlinkRelative task is like Symlink, but the target path is made relative
+// to the link's directory, so that the link keeps working if the directory
+// tree is moved.
+func SymlinkRelative(linkPath, target string) Task {
+	return actionFunc("link "+linkPath+" to "+target, func() error {
+		rel, err := relativeTarget(linkPath, target)
+		if err != nil {
+			return err
+		}
 
-	var perm os.FileMode = 0644
-	if executable {
-		perm = 0755
-	}
-	if err := dest.Chmod(perm); err != nil {
-		return err
-	}
+		logInfo("Linking", linkPath, "->", rel)
+		if err := symlinkAtomic(rel, linkPath); err != nil {
+			return err
+		}
+		recordOutput(linkPath)
+		return nil
+	})
+}
 
-	if err := dest.Sync(); err != nil {
-		return err
+func relativeTarget(linkPath, target string) (string, error) {
+	linkDir, err := filepath.Abs(filepath.Dir(linkPath))
+	if err != nil {
+		return "", err
 	}
 
-	err = dest.Close()
-	closed = true
+	absTarget, err := filepath.Abs(target)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	if err := os.Rename(dest.Name(), destName); err != nil {
-		return err
+	rel, err := filepath.Rel(linkDir, absTarget)
+	if err != nil {
+		// E.g. different volumes on Windows.
+		return "", fmt.Errorf("cannot make %s relative to %s: %v", target, linkDir, err)
 	}
+	return rel, nil
+}
 
-	return nil
+// Installation task.
+func Installation(destName, sourceName string, executable bool) Task {
+	return InstallationWith(destName, sourceName, InstallOptions{Executable: executable})
 }
 
-// Env variables.
-type Env map[string]string
+// InstallationWith options task.
+func InstallationWith(destName, sourceName string, opt InstallOptions) Task {
+	return actionFunc("install "+sourceName+" as "+destName, func() error {
+		return InstallWith(destName, sourceName, opt)
+	})
+}
 
-// Command task.
-func (env Env) Command(command ...interface{}) Task {
-	return Task{
-		command: Flatten(command),
-		env:     env,
-		tag:     new(tag),
-	}
+// Install file.
+func Install(destination, sourceName string, executable bool) error {
+	return InstallWith(destination, sourceName, InstallOptions{Executable: executable})
 }
 
-// CommandWrap task.
-func (env Env) CommandWrap(optional string, command ...interface{}) Task {
-	return Task{
-		command: Wrap(optional, command),
+// InstallAll task installs files into a directory.  The files are installed
+// concurrently, each of them atomically.  If some installations fail, the
+// first error is reported.
+func InstallAll(destDir string, sources func() []string, executable bool) Task {
+	return actionFunc("install files into "+destDir, func() error {
+		if err := mkdirAll(destDir); err != nil {
+			return err
+		}
+
+		names := sources()
+		jobs := make(chan string)
+
+		var (
+			wg     sync.WaitGroup
+			mu     sync.Mutex
+			errs   []error
+			dest   = strings.TrimSuffix(destDir, "/") + "/"
+			opt    = InstallOptions{Executable: executable}
+			worker = func() {
+				defer wg.Done()
+				for name := range jobs {
+					if err := InstallWith(dest, name, opt); err != nil {
+						mu.Lock()
+						errs = append(errs, err)
+						mu.Unlock()
+					}
+				}
+			}
+		)
+
+		workers := runtime.NumCPU()
+		if workers > len(names) {
+			workers = len(names)
+		}
+		wg.Add(workers)
+		for i := 0; i < workers; i++ {
+			go worker()
+		}
+
+		for _, name := range names {
+			jobs <- name
+		}
+		close(jobs)
+		wg.Wait()
+
+		switch len(errs) {
+		case 0:
+			return nil
+		case 1:
+			return errs[0]
+		default:
+			return fmt.Errorf("%v (and %d other error(s))", errs[0], len(errs)-1)
+		}
+	})
+}
+
+// InstallOptions for InstallWith and InstallationWith.
+type InstallOptions struct {
+	// Executable file gets mode 0755 instead of 0644.
+	Executable bool
+
+	// PreserveSymlink causes a source which is a symbolic link to be
+	// installed as a symbolic link with the same target.  By default the
+	// contents of the file it refers to are copied.  A relative target is
+	// not adjusted, so it may refer to a different file at the destination.
+	PreserveSymlink bool
+
+	// Link the destination to the source file (hard link) instead of copying
+	// it, if possible.  The data is copied if the mode of the source file
+	// is not the installation mode, the files are on different devices, or
+	// linking fails otherwise.  Note that the files share contents:
+	// modifying one of them affects the other.
+	Link bool
+
+	// Verify reads the destination file after installation and compares
+	// its contents with the source data, failing if they differ.  It
+	// doubles the amount of I/O, which may be noticeable with large files.
+	// A hard link (see Link) is verified by reading both files, and a
+	// symbolic link (see PreserveSymlink) by comparing the link targets.
+	Verify bool
+
+	// After is called with the destination filename after installation.  If
+	// it returns an error, the previous destination file is restored (or the
+	// installed file is removed if there was none), and the installation
+	// fails.
+	After func(destName string) error
+}
+
+// InstallWith options.  If destination ends with a slash, the base name of
+// sourceName is appended to it.
+func InstallWith(destination, sourceName string, opt InstallOptions) error {
+	destName := destination
+	if strings.HasSuffix(destName, "/") {
+		destName = Join(destName, Base(sourceName))
+	}
+
+	if opt.After == nil {
+		return installFile(destName, sourceName, opt)
+	}
+
+	backup, err := backupFile(destName)
+	if err != nil {
+		return err
+	}
+	if backup != "" {
+		defer os.Remove(backup)
+	}
+
+	if err := installFile(destName, sourceName, opt); err != nil {
+		return err
+	}
+
+	if err := opt.After(destName); err != nil {
+		if backup != "" {
+			if e := os.Rename(backup, destName); e != nil {
+				logWarningf("Restoring %s: %v", destName, e)
+			}
+		} else {
+			os.Remove(destName)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// backupFile creates a hard link to an existing file, or a copy if linking is
+// not possible.  Empty string is returned if the file doesn't exist.
+func backupFile(filename string) (string, error) {
+	info, err := os.Lstat(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	f, err := ioutil.TempFile(Dir(filename), "."+Base(filename)+".*")
+	if err != nil {
+		return "", err
+	}
+	backup := f.Name()
+	f.Close()
+	os.Remove(backup)
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(filename)
+		if err != nil {
+			return "", err
+		}
+		return backup, os.Symlink(target, backup)
+	}
+
+	if err := os.Link(filename, backup); err != nil {
+		if err := copyFile(backup, filename, info.Mode().Perm()); err != nil {
+			os.Remove(backup)
+			return "", err
+		}
+	}
+	return backup, nil
+}
+
+func installFile(destName, sourceName string, opt InstallOptions) error {
+	if opt.PreserveSymlink {
+		info, err := os.Lstat(sourceName)
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(sourceName)
+			if err != nil {
+				return err
+			}
+
+			logInfo("Installing", destName)
+			if err := symlinkAtomic(target, destName); err != nil {
+				return err
+			}
+			if opt.Verify {
+				if t, err := os.Readlink(destName); err != nil {
+					return err
+				} else if t != target {
+					return fmt.Errorf("%s: link target differs from source after installation", destName)
+				}
+			}
+			recordOutput(destName)
+			return nil
+		}
+	}
+
+	if opt.Link {
+		linked, err := linkAtomic(destName, sourceName, opt.perm())
+		if err != nil {
+			return err
+		}
+		if linked {
+			if opt.Verify {
+				sum, err := fileSum(sourceName)
+				if err != nil {
+					return err
+				}
+				return verifyFile(destName, sum)
+			}
+			return nil
+		}
+	}
+
+	source, err := os.Open(sourceName)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	return installData(destName, source, opt)
+}
+
+func (opt InstallOptions) perm() os.FileMode {
+	if opt.Executable {
+		return 0755
+	}
+	return 0644
+}
+
+// linkAtomic creates or replaces a hard link.  Directories are created as
+// needed.  False is returned without error if the link couldn't be created, or
+// if the mode of the source file is not perm (the link shares it).
+func linkAtomic(destName, sourceName string, perm os.FileMode) (linked bool, err error) {
+	info, err := os.Stat(sourceName)
+	if err != nil {
+		return false, err
+	}
+	if info.Mode().Perm() != perm {
+		return false, nil
+	}
+
+	dir := Dir(destName)
+	if err := mkdirAll(dir); err != nil {
+		return false, err
+	}
+
+	// Reserve a temporary name.
+	f, err := ioutil.TempFile(dir, "."+Base(destName)+".*")
+	if err != nil {
+		return false, err
+	}
+	tempName := f.Name()
+	f.Close()
+	os.Remove(tempName)
+
+	if err := os.Link(sourceName, tempName); err != nil {
+		return false, nil
+	}
+
+	logInfo("Installing", destName)
+
+	if err := os.Rename(tempName, destName); err != nil {
+		os.Remove(tempName)
+		return false, err
+	}
+
+	recordOutput(destName)
+	return true, nil
+}
+
+// InstallData file.
+func InstallData(destName string, source io.Reader, executable bool) error {
+	return installData(destName, source, InstallOptions{Executable: executable})
+}
+
+func installData(destName string, source io.Reader, opt InstallOptions) error {
+	logInfo("Installing", destName)
+
+	dir := Dir(destName)
+	if err := mkdirAll(dir); err != nil {
+		return err
+	}
+
+	temp := Base(destName) + ".*"
+	if !strings.HasPrefix(temp, ".") {
+		temp = "." + temp
+	}
+
+	var (
+		ok     bool
+		closed bool
+		tmpdir bool
+	)
+
+	dest, err := ioutil.TempFile(dir, temp)
+	if err != nil {
+		// Fall back to TMPDIR; the file will be copied if it can't be
+		// renamed.
+		var e error
+		if dest, e = ioutil.TempFile("", temp); e != nil {
+			return err
+		}
+		tmpdir = true
+	}
+	defer func() {
+		if !ok {
+			os.Remove(dest.Name())
+		}
+		if !closed {
+			dest.Close()
+		}
+	}()
+
+	hash := sha256.New()
+	if opt.Verify {
+		source = io.TeeReader(source, hash)
+	}
+
+	if _, err := io.Copy(dest, source); err != nil {
+		return err
+	}
+
+	perm := opt.perm()
+	if err := dest.Chmod(perm); err != nil {
+		return err
+	}
+
+	if err := dest.Sync(); err != nil {
+		return err
+	}
+
+	err = dest.Close()
+	closed = true
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(dest.Name(), destName); err != nil {
+		// Renaming from TMPDIR may fail also due to permissions.
+		if !isCrossDevice(err) && !tmpdir {
+			return err
+		}
+		if err := copyCrossDevice(destName, dest.Name(), perm); err != nil {
+			return err
+		}
+	}
+
+	if opt.Verify {
+		if err := verifyFile(destName, hash.Sum(nil)); err != nil {
+			return err
+		}
+	}
+
+	if t, ok := SourceDateEpoch(); ok {
+		if err := os.Chtimes(destName, t, t); err != nil {
+			return err
+		}
+	}
+
+	recordOutput(destName)
+	return nil
+}
+
+func verifyFile(filename string, sum []byte) error {
+	actual, err := fileSum(filename)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(actual, sum) {
+		return fmt.Errorf("%s: contents differ from source after installation", filename)
+	}
+	return nil
+}
+
+// fileSum returns the SHA-256 hash of the contents of a file.
+func fileSum(filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// SourceDateEpoch returns the time specified by the SOURCE_DATE_EPOCH
+// environment variable (see https://reproducible-builds.org).  False is
+// returned if it is unset or invalid.  When it is set, installed files get it
+// as their modification time.
+func SourceDateEpoch() (time.Time, bool) {
+	s := os.Getenv("SOURCE_DATE_EPOCH")
+	if s == "" {
+		return time.Time{}, false
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		logWarningf("SOURCE_DATE_EPOCH: %v", err)
+		return time.Time{}, false
+	}
+
+	return time.Unix(n, 0), true
+}
+
+// copyCrossDevice is a fallback for renaming tempName to destName when they are
+// on different devices.  The data is copied to another temporary file next to
+// destName, which is then renamed.  destName is overwritten in place if that
+// fails due to device mismatch.  tempName is removed on success.
+func copyCrossDevice(destName, tempName string, perm os.FileMode) error {
+	f, err := ioutil.TempFile(Dir(destName), "."+Base(destName)+".*")
+	if err != nil {
+		return copyFileAndRemove(destName, tempName, perm)
+	}
+	siblingName := f.Name()
+	f.Close()
+
+	if err := copyFile(siblingName, tempName, perm); err != nil {
+		os.Remove(siblingName)
+		return err
+	}
+
+	if err := os.Rename(siblingName, destName); err != nil {
+		os.Remove(siblingName)
+		if !isCrossDevice(err) {
+			return err
+		}
+		return copyFileAndRemove(destName, tempName, perm)
+	}
+
+	return os.Remove(tempName)
+}
+
+func copyFileAndRemove(destName, sourceName string, perm os.FileMode) error {
+	if err := copyFile(destName, sourceName, perm); err != nil {
+		return err
+	}
+	return os.Remove(sourceName)
+}
+
+// symlinkAtomic creates or replaces a symbolic link.  Directories are created
+// as needed.
+func symlinkAtomic(target, linkName string) error {
+	dir := Dir(linkName)
+	if err := mkdirAll(dir); err != nil {
+		return err
+	}
+
+	// Reserve a temporary name.
+	f, err := ioutil.TempFile(dir, "."+Base(linkName)+".*")
+	if err != nil {
+		return err
+	}
+	tempName := f.Name()
+	f.Close()
+	os.Remove(tempName)
+
+	if err := os.Symlink(target, tempName); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tempName, linkName); err != nil {
+		os.Remove(tempName)
+		return err
+	}
+
+	return nil
+}
+
+func isCrossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
+
+// copyFile overwrites destName with the contents of sourceName.
+func copyFile(destName, sourceName string, perm os.FileMode) error {
+	source, err := os.Open(sourceName)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	dest, err := os.OpenFile(destName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	if _, err := io.Copy(dest, source); err != nil {
+		return err
+	}
+
+	if err := dest.Chmod(perm); err != nil {
+		return err
+	}
+
+	if err := dest.Sync(); err != nil {
+		return err
+	}
+
+	return dest.Close()
+}
+
+// Env variables.  References to other environment variables in the values
+// ($VAR or ${VAR}) are expanded using the environment of this program when a
+// command is run.  References to unset variables and other uses of $ are left
+// intact.  $$ is replaced with a literal $ (see EscapeEnv).  Commands are
+// printed with unexpanded values.
+type Env map[string]string
+
+// EscapeEnv prevents expansion of a value which is used in Env.
+func EscapeEnv(value string) string {
+	return strings.Replace(value, "$", "$$", -1)
+}
+
+// expandEnv expands an Env value.  Only $NAME and ${NAME} are expanded, where
+// NAME is a valid identifier of a set variable, and $$ is replaced with $.
+// Everything else is copied as is.  Secret references are returned as is.
+func expandEnv(value string) string {
+	if isSecretRef(value) || !strings.Contains(value, "$") {
+		return value
+	}
+
+	var b strings.Builder
+
+	for i := 0; i < len(value); {
+		if value[i] != '$' || i+1 == len(value) {
+			b.WriteByte(value[i])
+			i++
+			continue
+		}
+
+		if value[i+1] == '$' {
+			b.WriteByte('$')
+			i += 2
+			continue
+		}
+
+		start, end, next := i+1, i+1, i+1
+		if value[i+1] == '{' {
+			start = i + 2
+			end = start + envNameLen(value[start:])
+			next = end + 1
+			if end == start || end == len(value) || value[end] != '}' {
+				end = start // Not a reference.
+			}
+		} else {
+			end = start + envNameLen(value[start:])
+			next = end
+		}
+
+		if end > start {
+			if v, ok := os.LookupEnv(value[start:end]); ok {
+				b.WriteString(v)
+				i = next
+				continue
+			}
+		}
+
+		b.WriteByte('$')
+		i++
+	}
+
+	return b.String()
+}
+
+// envNameLen returns the length of the identifier at the start of s.
+func envNameLen(s string) int {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c == '_' || 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || i > 0 && '0' <= c && c <= '9') {
+			return i
+		}
+	}
+	return len(s)
+}
+
+// Command task.
+func (env Env) Command(command ...interface{}) Task {
+	return Task{
+		command: Flatten(command),
+		env:     env,
+		tag:     new(tag),
+	}
+}
+
+// CommandWrap task.
+func (env Env) CommandWrap(optional string, command ...interface{}) Task {
+	return Task{
+		command: Wrap(optional, command),
+		env:     env,
+		tag:     new(tag),
+	}
+}
+
+// System task.
+func (env Env) System(commandline string) Task {
+	return Task{
+		command: strings.Fields(commandline),
+		env:     env,
+		tag:     new(tag),
+	}
+}
+
+// CommandAllowExit task treats the listed nonzero exit codes as success.
+func (env Env) CommandAllowExit(codes []int, command ...interface{}) Task {
+	return Task{
+		command:   Flatten(command),
+		env:       env,
+		allowExit: codes,
+		tag:       new(tag),
+	}
+}
+
+// CommandExitCode task stores the exit code of the command in *dest instead of
+// failing the build.  -1 is stored if the command couldn't be run or was
+// terminated by a signal.
+func (env Env) CommandExitCode(dest *int, command ...interface{}) Task {
+	return Task{
+		command:  Flatten(command),
+		env:      env,
+		exitCode: dest,
+		tag:      new(tag),
+	}
+}
+
+// CommandStderr task writes the standard error output of the command to a
+// file.  Directories are created as needed.
+func (env Env) CommandStderr(filename string, command ...interface{}) Task {
+	return Task{
+		command:    Flatten(command),
+		env:        env,
+		stderrFile: filename,
+		tag:        new(tag),
+	}
+}
+
+// Script task runs the commands in order in a directory, stopping at the first
+// failure.  Each command is a list of arguments which will be Flatten'ed.
+func (env Env) Script(dir string, commands ...[]interface{}) Task {
+	var tasks []Task
+	for _, command := range commands {
+		tasks = append(tasks, Task{
+			command: Flatten(command),
+			env:     env,
+			dir:     dir,
+			tag:     new(tag),
+		})
+	}
+	return Group(tasks...)
+}
+
+// CommandLimits task runs the command with resource limits: mem is the maximum
+// size of virtual memory in bytes (RLIMIT_AS), and cpuSec is the maximum CPU
+// time in seconds (RLIMIT_CPU).  Zero means no limit.  The limits are not
+// supported on all platforms; a warning is printed and the command is run
+// without them.
+func (env Env) CommandLimits(mem int64, cpuSec int, command ...interface{}) Task {
+	return Task{
+		command: Flatten(command),
+		env:     env,
+		limits:  &resourceLimits{mem, cpuSec},
+		tag:     new(tag),
+	}
+}
+
+// CommandUser task runs the command with the specified user and group ids.
+// It usually requires privileges (e.g. running as root), and is not supported
+// on all platforms; the task fails if the command cannot be started.
+func (env Env) CommandUser(uid, gid int, command ...interface{}) Task {
+	return Task{
+		command: Flatten(command),
+		env:     env,
+		user:    &userCredential{uid, gid},
+		tag:     new(tag),
+	}
+}
+
+// CommandPTY task runs the command with a pseudo-terminal as its controlling
+// terminal, standard input, output and error, so that it behaves like it was
+// run interactively (e.g. prints colors and progress).  The output is
+// forwarded to stdout.  Pseudo-terminals are supported only on Linux; on
+// other platforms a warning is printed and the command is run normally.
+func (env Env) CommandPTY(command ...interface{}) Task {
+	return Task{
+		command: Flatten(command),
 		env:     env,
+		pty:     true,
 		tag:     new(tag),
 	}
 }
 
-// System task.
-func (env Env) System(commandline string) Task {
-	return Task{
-		command: strings.Fields(commandline),
-		env:     env,
-		tag:     new(tag),
+// CommandResult task stores the outcome of the command in *res.  The result is
+// stored also if the command fails (which fails the build).
+func (env Env) CommandResult(res *CommandResult, command ...interface{}) Task {
+	return Task{
+		command: Flatten(command),
+		env:     env,
+		result:  res,
+		tag:     new(tag),
+	}
+}
+
+// CommandExpect task fails if the standard output of the command is not the
+// expected string.  Trailing newline is ignored.
+func (env Env) CommandExpect(expected string, command ...interface{}) Task {
+	return Task{
+		command: Flatten(command),
+		env:     env,
+		expect: func(output string) error {
+			if output != expected {
+				return fmt.Errorf("expected output %q, got %q", expected, output)
+			}
+			return nil
+		},
+		tag: new(tag),
+	}
+}
+
+// CommandMatch task fails if the standard output of the command doesn't
+// match the regular expression.  Trailing newline is ignored.  Invalid
+// pattern causes a panic.
+func (env Env) CommandMatch(pattern string, command ...interface{}) Task {
+	re := regexp.MustCompile(pattern)
+
+	return Task{
+		command: Flatten(command),
+		env:     env,
+		expect: func(output string) error {
+			if !re.MatchString(output) {
+				return fmt.Errorf("expected output matching %q, got %q", pattern, output)
+			}
+			return nil
+		},
+		tag: new(tag),
+	}
+}
+
+// CommandResult holds the outcome of a command.
+type CommandResult struct {
+	ExitCode int // -1 if the command couldn't be run or was terminated by a signal.
+	Stdout   []byte
+	Duration time.Duration
+	Err      error
+}
+
+// String of environment variables.
+func (env Env) String() string {
+	var pairs []string
+	for k, v := range env {
+		pairs = append(pairs, maybeQuote(k)+"="+maybeQuote(maskEnvValue(v)))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// All conditions.
+func All(conds ...func() bool) func() bool {
+	if len(conds) == 1 {
+		return conds[0]
+	}
+
+	return func() bool {
+		for _, cond := range conds {
+			if !cond() {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Any condition.
+func Any(conds ...func() bool) func() bool {
+	if len(conds) == 1 {
+		return conds[0]
+	}
+
+	return func() bool {
+		for _, cond := range conds {
+			if cond() {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// CondErr is a condition which may fail.
+type CondErr func() (bool, error)
+
+// NoErr converts an infallible condition to CondErr.
+func NoErr(cond func() bool) CondErr {
+	return func() (bool, error) {
+		return cond(), nil
+	}
+}
+
+// AllErr conditions.  Evaluation stops at the first error.
+func AllErr(conds ...CondErr) CondErr {
+	if len(conds) == 1 {
+		return conds[0]
+	}
+
+	return func() (bool, error) {
+		for _, cond := range conds {
+			if ok, err := cond(); err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+}
+
+// AnyErr condition.  Evaluation stops at the first error.
+func AnyErr(conds ...CondErr) CondErr {
+	if len(conds) == 1 {
+		return conds[0]
+	}
+
+	return func() (bool, error) {
+		for _, cond := range conds {
+			ok, err := cond()
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+}
+
+var globalDeps []string
+
+// Outdated condition.
+func Outdated(target string, sources func() []string) func() bool {
+	return OutdatedFunc(target, sources, func(target, source os.FileInfo) bool {
+		return source.ModTime().After(target.ModTime())
+	})
+}
+
+// OutdatedFunc condition is like Outdated, but cmp decides if the target is
+// outdated with respect to a source (or a universal dependency).  The
+// condition is true if the target doesn't exist.
+func OutdatedFunc(target string, sources func() []string, cmp func(target, source os.FileInfo) bool) func() bool {
+	return func() bool {
+		targetInfo, err := os.Stat(target)
+		if err != nil {
+			return true
+		}
+
+		deps := globalDeps
+		if sources != nil {
+			deps = append([]string(nil), deps...)
+			deps = append(deps, sources()...)
+		}
+
+		for _, source := range deps {
+			info, err := os.Stat(source)
+			if err != nil {
+				logWarningf("%s dependency %s: %v", target, source, err)
+				return true
+			}
+
+			if cmp(targetInfo, info) {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// OutdatedFiles is like Outdated, but the sources are listed directly.
+func OutdatedFiles(target string, sources ...string) func() bool {
+	return Outdated(target, Thunk(sources...))
+}
+
+// Newer condition is true if file a has been modified after file b, or if b
+// doesn't exist.  It is false if a doesn't exist.
+func Newer(a, b string) func() bool {
+	return func() bool {
+		infoA, err := os.Stat(a)
+		if err != nil {
+			return false
+		}
+
+		infoB, err := os.Stat(b)
+		if err != nil {
+			return true
+		}
+
+		return infoA.ModTime().After(infoB.ModTime())
+	}
+}
+
+// OnOS condition is true if the build host's GOOS is one of the names.
+func OnOS(names ...string) func() bool {
+	return func() bool {
+		return containsString(names, GOOS)
+	}
+}
+
+// OnArch condition is true if the build host's GOARCH is one of the names.
+func OnArch(names ...string) func() bool {
+	return func() bool {
+		return containsString(names, GOARCH)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Missing condition.
+func Missing(path string) func() bool {
+	return func() bool {
+		return !Exists(path)
 	}
 }
 
-// String of environment variables.
-func (env Env) String() string {
-	var pairs []string
-	for k, v := range env {
-		pairs = append(pairs, maybeQuote(k)+"="+maybeQuote(v))
+// Not condition.
+func Not(cond func() bool) func() bool {
+	return func() bool {
+		return !cond()
 	}
-	sort.Strings(pairs)
-	return strings.Join(pairs, " ")
 }
 
-// All conditions.
-func All(conds ...func() bool) func() bool {
-	if len(conds) == 1 {
-		return conds[0]
-	}
+// FileContains condition matches the contents of a file against a regular
+// expression.  False is returned if the file cannot be read.  Invalid pattern
+// causes a panic.
+func FileContains(path, pattern string) func() bool {
+	return FileContainsOr(path, pattern, false)
+}
+
+// FileContainsOr is like FileContains, but the result is specified for the
+// case when the file cannot be read.
+func FileContainsOr(path, pattern string, unreadable bool) func() bool {
+	re := regexp.MustCompile(pattern)
 
 	return func() bool {
-		for _, cond := range conds {
-			if !cond() {
-				return false
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return unreadable
+		}
+		return re.Match(data)
+	}
+}
+
+// Rule task runs the task if target is Outdated with respect to sources.  If
+// target wasn't modified by the task, it is touched (or created) afterwards.
+func Rule(target string, sources func() []string, task Task) Task {
+	var before time.Time
+
+	outdated := Outdated(target, sources)
+
+	t := If(
+		func() bool {
+			before = time.Time{}
+			if info, err := os.Stat(target); err == nil {
+				before = info.ModTime()
+			}
+			return outdated()
+		},
+		task,
+		Func(func() error {
+			info, err := os.Stat(target)
+			if err != nil {
+				return Touch(target)
+			}
+			if info.ModTime().After(before) {
+				return nil
+			}
+			now := time.Now()
+			return os.Chtimes(target, now, now)
+		}),
+	)
+	t.rule = &rule{target, sources}
+	return t
+}
+
+// Thunk returns a function which returns the string in a slice.
+func Thunk(strings ...string) func() []string {
+	return func() []string {
+		return strings
+	}
+}
+
+type resourceLimits struct {
+	mem int64
+	cpu int
+}
+
+type userCredential struct {
+	uid int
+	gid int
+}
+
+type tag struct {
+	dummy func()
+}
+
+// Task to run.
+type Task struct {
+	name       string
+	isDefault  bool
+	quiet      bool
+	hidden     bool
+	labels     []string
+	tasks      []Task
+	command    []string
+	env        Env
+	envFunc    func() Env
+	dir        string
+	function   func() error
+	desc       string // Name of function.
+	action     string // Description of built-in function.
+	conds      []CondErr
+	allowExit  []int
+	exitCode   *int
+	stderrFile string
+	collapse   int
+	limits     *resourceLimits
+	user       *userCredential
+	timeout    time.Duration
+	pty        bool
+	rule       *rule
+	result     *CommandResult
+	expect     func(output string) error
+	dynamic    func() ([]Task, error) // Subtasks determined at run time.
+	finally    []Task                 // Run after the task even if it fails.
+	custom     func(*runner) error
+
+	tag *tag
+}
+
+// summary of the subtasks, for diagnostics.
+func (task Task) summary() string {
+	for _, subtask := range task.tasks {
+		if len(subtask.command) > 0 || subtask.action != "" || subtask.desc != "" {
+			if len(task.tasks) > 1 {
+				return subtask.Describe() + " etc."
+			}
+			return subtask.Describe()
+		}
+	}
+	return fmt.Sprintf("%d task(s)", len(task.tasks))
+}
+
+// Describe the task for diagnostics.  Command tasks are described by their
+// command line, function tasks by the function name, and others by their
+// structure.
+func (task Task) Describe() string {
+	switch {
+	case len(task.command) > 0:
+		return task.commandline()
+
+	case task.function != nil:
+		if task.desc != "" {
+			return task.desc
+		}
+		if task.action != "" {
+			return task.action
+		}
+		return "function " + funcName(task.function)
+
+	case task.custom != nil:
+		return "custom task"
+
+	case task.dynamic != nil:
+		return "dynamic task group"
+
+	case task.name != "":
+		return "target " + task.name
+
+	case len(task.tasks) > 0:
+		return fmt.Sprintf("group of %d", len(task.tasks))
+
+	default:
+		return "empty task"
+	}
+}
+
+func funcName(f interface{}) string {
+	name := "?"
+	if fn := runtime.FuncForPC(reflect.ValueOf(f).Pointer()); fn != nil {
+		name = fn.Name()
+	}
+	return path.Base(name)
+}
+
+// Quiet target doesn't report if there was nothing to be done.  Returns a
+// copy.
+func (task Task) Quiet() Task {
+	task.quiet = true
+	return task
+}
+
+// Then returns a task which runs the task and then the next task.  If the
+// task is a target, the returned task is the target instead.
+func (task Task) Then(next Task) Task {
+	outer := task.unwrap()
+	outer.tasks = []Task{task, next}
+	return outer
+}
+
+// Finally returns a task which runs the task and then the cleanup task, even
+// if the task fails or is skipped due to a condition.  If the build is
+// aborted (e.g. due to a deadline), the cleanup task is given at most one
+// minute.  If the task is a target, the returned task is the target instead.
+func (task Task) Finally(cleanup Task) Task {
+	outer := task.unwrap()
+	outer.tasks = []Task{task}
+	outer.finally = []Task{cleanup}
+	return outer
+}
+
+// unwrap returns a new task with the target properties of the task, and
+// clears them in the task.
+func (task *Task) unwrap() Task {
+	outer := Task{
+		name:      task.name,
+		isDefault: task.isDefault,
+		quiet:     task.quiet,
+		hidden:    task.hidden,
+		labels:    task.labels,
+		tag:       new(tag),
+	}
+
+	task.name = ""
+	task.isDefault = false
+	task.quiet = false
+	task.hidden = false
+	task.labels = nil
+	return outer
+}
+
+// Hidden target is not listed in usage or by the --targets option, but it can
+// be run by name.  Returns a copy.
+func (task Task) Hidden() Task {
+	task.hidden = true
+	return task
+}
+
+// Timeout kills the command if it runs longer than d, failing the build.  It
+// overrides the --command-timeout option.  Returns a copy.
+func (task Task) Timeout(d time.Duration) Task {
+	task.timeout = d
+	return task
+}
+
+// Label the task and its subtasks for selection using the --only and --skip
+// options.  Returns a copy.
+func (task Task) Label(labels ...string) Task {
+	task.labels = append(append([]string(nil), task.labels...), labels...)
+	return task
+}
+
+func (task Task) hasLabel(set map[string]struct{}) bool {
+	for _, label := range task.labels {
+		if _, found := set[label]; found {
+			return true
+		}
+	}
+	return false
+}
+
+func (task Task) commandline() string {
+	var cmd []string
+	for _, s := range task.command {
+		cmd = append(cmd, maybeQuote(s))
+	}
+	line := strings.Join(cmd, " ")
+	if len(task.env) > 0 {
+		line = task.env.String() + " " + line
+	}
+	line = maskSecrets(line)
+	if task.dir != "" {
+		line = "cd " + maybeQuote(task.dir) + " && " + line
+	}
+	if task.stderrFile != "" {
+		line += " 2> " + maybeQuote(task.stderrFile)
+	}
+	if l := task.limits; l != nil {
+		if l.mem > 0 {
+			line += fmt.Sprintf(" (memory limit %d)", l.mem)
+		}
+		if l.cpu > 0 {
+			line += fmt.Sprintf(" (CPU limit %ds)", l.cpu)
+		}
+	}
+	if u := task.user; u != nil {
+		line += fmt.Sprintf(" (user %d:%d)", u.uid, u.gid)
+	}
+	if len(task.allowExit) > 0 {
+		var codes []string
+		for _, code := range task.allowExit {
+			codes = append(codes, strconv.Itoa(code))
+		}
+		line += " (allowed exit status " + strings.Join(codes, ", ") + ")"
+	}
+	return line
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return exit.ExitCode()
+	}
+	return -1
+}
+
+func (task Task) exitAllowed(err error) bool {
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) {
+		return false
+	}
+
+	code := exit.ExitCode()
+	for _, allowed := range task.allowExit {
+		if code == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// cmd for a command task.  Output is not redirected.
+func (task Task) cmd(ctx context.Context) (*exec.Cmd, error) {
+	env, err := task.environ()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, task.command[0], task.command[1:]...)
+	cmd.Env = env
+	cmd.Dir = task.dir
+	return cmd, nil
+}
+
+// environ reads secret files referred to by the environment.
+func (task Task) environ() ([]string, error) {
+	if task.env == nil {
+		return nil, nil
+	}
+
+	e := os.Environ()
+	for k, v := range task.env {
+		if isSecretRef(v) {
+			secret, err := readSecretRef(v)
+			if err != nil {
+				return nil, err
+			}
+			e = append(e, k+"="+secret)
+		} else {
+			e = append(e, k+"="+expandEnv(v))
+		}
+	}
+
+	return e, nil
+}
+
+// Tasks slice.
+type Tasks []Task
+
+// Add task at the end of the slice.  Returns a copy.
+func (ptr *Tasks) Add(task Task) Task {
+	*ptr = append(*ptr, task)
+	return task
+}
+
+var commandHook func(argv []string, env Env) []string
+
+// SetCommandHook sets a function which is called with the arguments and
+// environment of each command task before it is run.  The returned arguments
+// are executed instead; if nil is returned, the command is skipped.  The hook
+// is called before the command is logged, so the "Running" line shows the
+// returned arguments.
+func SetCommandHook(f func(argv []string, env Env) []string) {
+	commandHook = f
+}
+
+// finallyTimeout limits the cleanup tasks which are run after the build has
+// been aborted.
+const finallyTimeout = time.Minute
+
+// keptGoingError is returned by a task whose subtargets failed with the
+// --keep-going option.  The errors have already been reported.
+type keptGoingError struct {
+	n int
+}
+
+func (e *keptGoingError) Error() string {
+	return fmt.Sprintf("%d target(s) failed", e.n)
+}
+
+// hooked returns a command task with the environment function and the command
+// hook applied.  The command is empty if the hook skips it.
+func (task Task) hooked() Task {
+	if task.envFunc != nil {
+		task.env = task.envFunc()
+	}
+
+	if commandHook != nil {
+		task.command = commandHook(append([]string(nil), task.command...), task.env)
+	}
+
+	return task
+}
+
+// runner holds the state of a build.
+type runner struct {
+	ctx      context.Context
+	cache    map[*tag]struct{}
+	selected bool // The current task or its parent has an --only label.
+}
+
+// newRunner for a new build.  Memo values are discarded.
+func newRunner(ctx context.Context) *runner {
+	resetMemo()
+
+	return &runner{
+		ctx:   ctx,
+		cache: make(map[*tag]struct{}),
+	}
+}
+
+// rerunner returns a runner which runs tasks again, and uses the given
+// context.  Results of cached conditions and memo values are discarded.
+func (r *runner) rerunner(ctx context.Context) *runner {
+	nextCondGeneration()
+	resetMemo()
+
+	x := *r
+	x.ctx = ctx
+	x.cache = make(map[*tag]struct{})
+	return &x
+}
+
+// condRecords collects the state which conditions want to store after the
+// tasks guarded by them have been run successfully.
+var condRecords struct {
+	mu         sync.Mutex
+	collecting bool
+	funcs      []func()
+}
+
+// recordOnSuccess calls f after the tasks guarded by the condition which is
+// being evaluated have been run successfully.  If no task is evaluating
+// conditions, f is called immediately.
+func recordOnSuccess(f func()) {
+	condRecords.mu.Lock()
+	collecting := condRecords.collecting
+	if collecting {
+		condRecords.funcs = append(condRecords.funcs, f)
+	}
+	condRecords.mu.Unlock()
+
+	if !collecting {
+		f()
+	}
+}
+
+// checkConds evaluates the conditions of a task.  The functions registered via
+// recordOnSuccess during the evaluation are returned if all conditions are
+// true.
+func checkConds(task Task) (ok bool, records []func(), err error) {
+	condRecords.mu.Lock()
+	condRecords.collecting = true
+	condRecords.mu.Unlock()
+
+	defer func() {
+		condRecords.mu.Lock()
+		if ok && err == nil {
+			records = condRecords.funcs
+		}
+		condRecords.funcs = nil
+		condRecords.collecting = false
+		condRecords.mu.Unlock()
+	}()
+
+	for i, cond := range task.conds {
+		ok, err := cond()
+		if err == nil {
+			if err := planCondition(task, ok); err != nil {
+				return false, nil, err
+			}
+		}
+		if err != nil || !ok {
+			if err == nil && progress.enabled {
+				progressSkip(task)
+			}
+			if err == nil && why {
+				reason := "condition is false"
+				if len(task.conds) > 1 {
+					reason = fmt.Sprintf("condition %d of %d is false", i+1, len(task.conds))
+				}
+				logInfo("Skipping", task.summary(), "("+reason+")")
+			}
+			return false, nil, err
+		}
+	}
+
+	return true, nil, nil
+}
+
+func (r *runner) run(task Task) (worked bool, err error) {
+	if task.tag == nil {
+		return false, errors.New("Task values must not be created directly")
+	}
+	if _, done := r.cache[task.tag]; done {
+		return false, nil
+	}
+	r.cache[task.tag] = struct{}{}
+
+	if task.name != "" {
+		// ErrStop ends only the target which it was returned from.
+		defer func() {
+			if errors.Is(err, ErrStop) {
+				worked, err = true, nil
+			}
+		}()
+	}
+
+	if err := r.ctx.Err(); err != nil {
+		return false, err
+	}
+	if err := brokenPipeError(); err != nil {
+		return false, err
+	}
+
+	if task.hasLabel(skipLabels) {
+		return false, nil
+	}
+
+	if !r.selected && task.hasLabel(onlyLabels) {
+		r.selected = true
+		defer func() { r.selected = false }()
+	}
+
+	if len(task.finally) > 0 {
+		defer func() {
+			cr := r
+			if r.ctx.Err() != nil {
+				// The build was aborted, but cleanup must still be done.
+				ctx, cancel := context.WithTimeout(context.Background(), finallyTimeout)
+				defer cancel()
+
+				x := *r
+				x.ctx = ctx
+				cr = &x
+			}
+
+			for _, cleanup := range task.finally {
+				ok, e := cr.run(cleanup)
+				if ok {
+					worked = true
+				}
+				if err == nil {
+					err = e
+				}
+			}
+		}()
+	}
+
+	if len(task.conds) > 0 {
+		ok, records, err := checkConds(task)
+		if err != nil || !ok {
+			return false, err
+		}
+
+		if len(records) > 0 {
+			defer func() {
+				// Partial builds are not recorded.
+				if err == nil && !dryRun && len(skipLabels) == 0 && (len(onlyLabels) == 0 || r.selected) {
+					for _, f := range records {
+						f()
+					}
+				}
+			}()
+		}
+	}
+
+	if progress.enabled && (task.name != "" || len(task.command) > 0 || task.function != nil || task.custom != nil) {
+		finish := progressTask(task)
+		defer func() { finish(err) }()
+	}
+
+	subtasks := task.tasks
+	if task.dynamic != nil {
+		if subtasks, err = task.dynamic(); err != nil {
+			return false, err
+		}
+	}
+
+	failed := 0
+
+	for _, subtask := range subtasks {
+		if failed > 0 && subtask.name == "" {
+			continue // Only other targets are run after a failure.
+		}
+
+		ok, err := r.run(subtask)
+		if ok {
+			worked = true
+		}
+		if err != nil {
+			if !keepGoing || r.ctx.Err() != nil || isBrokenPipe(err) {
+				return worked, err
+			}
+
+			var kept *keptGoingError
+			if errors.As(err, &kept) {
+				failed += kept.n
+			} else if subtask.name != "" {
+				logError(subtask.name+":", err)
+				failed++
+			} else {
+				return worked, err
 			}
 		}
-		return true
 	}
-}
 
-// Any condition.
-func Any(conds ...func() bool) func() bool {
-	if len(conds) == 1 {
-		return conds[0]
+	if failed > 0 {
+		return worked, &keptGoingError{failed}
 	}
 
-	return func() bool {
-		for _, cond := range conds {
-			if cond() {
-				return true
-			}
-		}
-		return false
+	if len(onlyLabels) > 0 && !r.selected {
+		delete(r.cache, task.tag) // May be selected via another parent.
+		return worked, nil
 	}
-}
 
-var globalDeps []string
+	if len(task.command) > 0 {
+		task = task.hooked()
+	}
 
-// Outdated condition.
-func Outdated(target string, sources func() []string) func() bool {
-	return func() bool {
-		info, err := os.Stat(target)
-		if err != nil {
-			return true
+	if len(task.command) > 0 {
+		if dryRun {
+			if err := planCommand(task); err != nil {
+				return true, err
+			}
+			_, err := fmt.Println(task.commandline())
+			return true, err
+		}
+
+		if err := r.runCommand(task); err != nil {
+			return true, err
 		}
 
-		targetTime := info.ModTime()
+		worked = true
+	}
 
-		deps := globalDeps
-		if sources != nil {
-			deps = append([]string(nil), deps...)
-			deps = append(deps, sources()...)
+	if dryRun && (task.function != nil || task.custom != nil) {
+		return worked, planFunction(task)
+	}
+
+	if task.function != nil {
+		if task.desc != "" {
+			logInfo("Running", task.desc)
 		}
 
-		for _, source := range deps {
-			info, err := os.Stat(source)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "%s dependency %s: %v\n", target, source, err)
-				return true
+		if err := task.function(); err != nil {
+			if task.desc != "" && err != ErrStop {
+				err = fmt.Errorf("task %s failed: %w", task.desc, err)
 			}
+			return true, err
+		}
 
-			if info.ModTime().After(targetTime) {
-				return true
-			}
+		worked = true
+	}
+
+	if task.custom != nil {
+		if err := task.custom(r); err != nil {
+			return true, err
 		}
 
-		return false
+		worked = true
 	}
+
+	return worked, nil
 }
 
-// Missing condition.
-func Missing(path string) func() bool {
-	return func() bool {
-		return !Exists(path)
-	}
+var programName string
+
+// SetProgramName overrides the program name displayed in usage.  By default it
+// is "go run" followed by the main filename passed to Main, or the executable
+// name.
+func SetProgramName(name string) {
+	programName = name
 }
 
-// Thunk returns a function which returns the string in a slice.
-func Thunk(strings ...string) func() []string {
-	return func() []string {
-		return strings
-	}
+var (
+	usageHeader   string
+	usageExamples string
+)
+
+// SetUsageHeader sets text which is printed at the start of the usage
+// message, e.g. a description of the build.
+func SetUsageHeader(text string) {
+	usageHeader = text
 }
 
-type tag struct {
-	dummy func()
+// SetUsageExamples sets text which is printed in the Examples section at the
+// end of the usage message.  Each line is indented.
+func SetUsageExamples(text string) {
+	usageExamples = text
 }
 
-// Task to run.
-type Task struct {
-	name      string
-	isDefault bool
-	tasks     []Task
-	command   []string
-	env       Env
-	function  func() error
-	cond      func() bool
+var defaultTargetEnv string
 
-	tag *tag
+// SetDefaultTargetEnv specifies an environment variable which names the
+// target to build if no targets are specified on the command-line and there
+// are no default targets.
+func SetDefaultTargetEnv(key string) {
+	defaultTargetEnv = key
 }
 
-func (task Task) commandline() string {
-	var cmd []string
-	for _, s := range task.command {
-		cmd = append(cmd, maybeQuote(s))
+func (r *runner) runCommand(task Task) error {
+	logInfo("Running", task.commandline())
+
+	ctx := r.ctx
+	timeout := task.timeout
+	if timeout == 0 {
+		timeout = commandTimeout
 	}
-	line := strings.Join(cmd, " ")
-	if len(task.env) > 0 {
-		line = task.env.String() + " " + line
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
-	return line
-}
 
-func (task Task) environ() []string {
-	if task.env == nil {
-		return nil
+	cmd, err := task.cmd(ctx)
+	if err != nil {
+		return err
 	}
-
-	e := os.Environ()
-	for k, v := range task.env {
-		e = append(e, k+"="+v)
+	if task.limits != nil {
+		if err := task.limits.apply(cmd); err != nil {
+			return err
+		}
+	}
+	if task.user != nil {
+		if err := task.user.apply(cmd); err != nil {
+			return err
+		}
+	}
+	if task.stderrFile != "" {
+		f, err := createFile(task.stderrFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		cmd.Stderr = f
 	}
 
-	return e
-}
+	sp := startSpinner(Base(task.command[0]))
+	cmd.Stdout = sp.writer(os.Stdout)
+	if cmd.Stderr == nil {
+		cmd.Stderr = sp.writer(os.Stderr)
+	}
 
-// Tasks slice.
-type Tasks []Task
+	var masked []*secretWriter
+	if haveSecrets() {
+		stdout := &secretWriter{out: cmd.Stdout}
+		stderr := &secretWriter{out: cmd.Stderr}
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		masked = append(masked, stdout, stderr)
+	}
 
-// Add task at the end of the slice.  Returns a copy.
-func (ptr *Tasks) Add(task Task) Task {
-	*ptr = append(*ptr, task)
-	return task
-}
+	var collapsed []*collapseWriter
+	if task.collapse > 0 && !verbose {
+		stdout := &collapseWriter{out: cmd.Stdout, n: task.collapse}
+		cmd.Stdout = stdout
+		collapsed = append(collapsed, stdout)
 
-func run(task Task, cache map[*tag]struct{}) bool {
-	if task.tag == nil {
-		fmt.Fprintln(os.Stderr, "Task values must not be created directly")
-		os.Exit(1)
+		if task.stderrFile == "" {
+			stderr := &collapseWriter{out: cmd.Stderr, n: task.collapse}
+			cmd.Stderr = stderr
+			collapsed = append(collapsed, stderr)
+		}
 	}
-	if _, done := cache[task.tag]; done {
-		return false
+
+	var stdout bytes.Buffer
+	if task.result != nil || task.expect != nil {
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, &stdout)
 	}
-	cache[task.tag] = struct{}{}
 
-	if task.cond != nil && !task.cond() {
-		return false
+	start := time.Now()
+	if task.pty {
+		err = runPTY(cmd)
+	} else {
+		err = cmd.Run()
 	}
+	sp.stop()
 
-	var worked bool
+	for _, w := range collapsed {
+		w.finish(err != nil && !task.exitAllowed(err))
+	}
+	for _, w := range masked {
+		w.flush()
+	}
 
-	for _, subtask := range task.tasks {
-		if run(subtask, cache) {
-			worked = true
+	if u := task.user; u != nil && err != nil {
+		var exit *exec.ExitError
+		if !errors.As(err, &exit) {
+			err = fmt.Errorf("running %s as user %d:%d: %w", task.command[0], u.uid, u.gid, err)
 		}
 	}
 
-	if len(task.command) > 0 {
-		Println("Running", task.commandline())
-		cmd := exec.Command(task.command[0], task.command[1:]...)
-		cmd.Env = task.environ()
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+	if task.result != nil {
+		*task.result = CommandResult{
+			ExitCode: exitCode(err),
+			Stdout:   stdout.Bytes(),
+			Duration: time.Since(start),
+			Err:      err,
 		}
-
-		worked = true
 	}
 
-	if task.function != nil {
-		if err := task.function(); err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+	if task.exitCode != nil && ctx.Err() == nil {
+		*task.exitCode = exitCode(err)
+		err = nil
+	}
+	if err != nil && !task.exitAllowed(err) {
+		if e := r.ctx.Err(); e != nil {
+			err = e
+		} else if ctx.Err() != nil {
+			err = fmt.Errorf("%s: command timed out after %v", task.command[0], timeout)
 		}
+		return err
+	}
 
-		worked = true
+	if task.expect != nil {
+		output := strings.TrimSuffix(stdout.String(), "\n")
+		if err := task.expect(output); err != nil {
+			return fmt.Errorf("%s: %v", task.command[0], err)
+		}
 	}
 
-	return worked
+	return nil
 }
 
 // Main program.
 func Main(getTargets func() Tasks, main string, deps ...string) {
+	os.Exit(MainArgs(os.Args[1:], getTargets, main, deps...))
+}
+
+// MainArgs is like Main, but the command-line arguments (excluding the
+// program name) are specified explicitly, and the exit code is returned
+// instead of exiting.  Options and variables set by the arguments don't
+// persist after the call.
+func MainArgs(args []string, getTargets func() Tasks, main string, deps ...string) int {
+	handleBrokenPipe()
+	defer saveState()()
+
 	if main != "" {
 		globalDeps = append(globalDeps, main)
 	}
 	globalDeps = append(globalDeps, deps...)
 
-	args := os.Args[1:]
+	if value := os.Getenv(commandTimeoutEnv); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			logError(commandTimeoutEnv+":", err)
+			return 2
+		}
+		commandTimeout = d
+	}
+
+	args, err := expandResponseFiles(args)
+	if err == nil {
+		args, err = parseOptions(args)
+	}
+	if err != nil {
+		logError(err)
+		return 2
+	}
+
+	if plan.filename != "" {
+		if err := openPlan(); err != nil {
+			logError(err)
+			return 1
+		}
+		defer func() {
+			if err := closePlan(); err != nil {
+				logError(err)
+			}
+		}()
+	}
+
+	if useSyslog {
+		tag := programName
+		if tag == "" {
+			tag = "make"
+		}
+		if f, err := openSyslog(tag); err == nil {
+			syslogger = f
+		} else {
+			logWarningf("Syslog: %v", err)
+		}
+	}
 
 	for _, arg := range args {
 		if strings.Contains(arg, "=") && !strings.HasPrefix(arg, "-") {
 			ss := strings.SplitN(arg, "=", 2)
-			Vars[ss[0]] = ss[1]
+			setVar(ss[0], ss[1])
 		}
 	}
 
@@ -623,31 +2648,73 @@ func Main(getTargets func() Tasks, main string, deps ...string) {
 	for _, arg := range args {
 		if strings.Contains(arg, "=") && !strings.HasPrefix(arg, "-") {
 			ss := strings.SplitN(arg, "=", 2)
-			if _, ok := varDefaults[ss[0]]; !ok {
-				fmt.Fprintln(os.Stderr, "Unknown variable:", ss[0])
-				os.Exit(2)
+			if !varRegistered(ss[0]) {
+				logError("Unknown variable:", ss[0])
+				return 2
+			}
+		}
+	}
+
+	if listTargets {
+		for _, task := range available {
+			if task.name != "" && !task.hidden {
+				if _, err := fmt.Println(task.name); err != nil && isBrokenPipe(err) {
+					return exitBrokenPipe
+				}
 			}
 		}
+		return 0
 	}
 
-	usage := func(exitcode int) {
+	usage := func(exitcode int) int {
 		metaTarget := "target"
 		if defaults {
 			metaTarget = "[TARGET]..."
 		}
 
-		prog := os.Args[0]
-		if main != "" {
-			prog = "go run " + main
+		prog := programName
+		if prog == "" {
+			prog = os.Args[0]
+			if main != "" {
+				prog = "go run " + main
+			}
+		}
+
+		if usageHeader != "" {
+			fmt.Fprintln(os.Stderr, strings.TrimRight(usageHeader, "\n"))
+			fmt.Fprintln(os.Stderr)
 		}
 
-		fmt.Fprintf(os.Stderr, "Usage: %s %s [VAR=value]...\n", prog, metaTarget)
+		fmt.Fprintf(os.Stderr, "Usage: %s [OPTION]... %s [VAR=value]...\n", prog, metaTarget)
+		fmt.Fprintf(os.Stderr, "       %s @FILE...\n", prog)
 		fmt.Fprintf(os.Stderr, "       %s -h|--help\n", prog)
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Options:")
+
+		var names []string
+		width := 0
+		for _, o := range options {
+			name := o.name
+			if o.metavar != "" {
+				name += "=" + o.metavar
+			}
+			if o.short != "" {
+				name = o.short + ", " + name
+			}
+			names = append(names, name)
+			if len(name) > width {
+				width = len(name)
+			}
+		}
+		for i, o := range options {
+			fmt.Fprintf(os.Stderr, "  %-*s  %s\n", width, names[i], o.help)
+		}
+
 		fmt.Fprintln(os.Stderr)
 		fmt.Fprintln(os.Stderr, "Targets:")
 
 		for _, task := range available {
-			if task.name != "" {
+			if task.name != "" && !task.hidden {
 				if task.isDefault {
 					fmt.Fprintf(os.Stderr, "  %s (default)\n", task.name)
 				} else {
@@ -656,23 +2723,18 @@ func Main(getTargets func() Tasks, main string, deps ...string) {
 			}
 		}
 
-		if len(varDefaults) > 0 {
+		if values := varValues(); len(values) > 0 {
 			fmt.Fprintln(os.Stderr)
 			fmt.Fprintln(os.Stderr, "Variables:")
 
 			var names []string
-			for name := range varDefaults {
+			for name := range values {
 				names = append(names, name)
 			}
 			sort.Strings(names)
 
 			for _, name := range names {
-				value, found := Vars[name]
-				if !found {
-					value = varDefaults[name]
-				}
-
-				if value == "" {
+				if value := values[name]; value == "" {
 					fmt.Fprintf(os.Stderr, "  %s\n", name)
 				} else {
 					fmt.Fprintf(os.Stderr, "  %s (%s)\n", name, value)
@@ -680,26 +2742,49 @@ func Main(getTargets func() Tasks, main string, deps ...string) {
 			}
 		}
 
+		if usageExamples != "" {
+			fmt.Fprintln(os.Stderr)
+			fmt.Fprintln(os.Stderr, "Examples:")
+
+			for _, line := range strings.Split(strings.TrimRight(usageExamples, "\n"), "\n") {
+				if line == "" {
+					fmt.Fprintln(os.Stderr)
+				} else {
+					fmt.Fprintln(os.Stderr, "  "+line)
+				}
+			}
+		}
+
 		fmt.Fprintln(os.Stderr)
-		os.Exit(exitcode)
+		return exitcode
 	}
 
 	if len(args) == 1 && (args[0] == "-h" || args[0] == "-help" || args[0] == "--help") {
-		usage(0)
+		return usage(0)
 	}
 
 	names := make(map[string]struct{})
 	for _, arg := range args {
 		if strings.HasPrefix(arg, "-") {
-			usage(2)
+			return usage(2)
 		}
 		if !strings.Contains(arg, "=") {
 			names[arg] = struct{}{}
 		}
 	}
 
+	if !defaults && len(names) == 0 && defaultTargetEnv != "" {
+		if name := os.Getenv(defaultTargetEnv); name != "" {
+			if !hasTarget(available, name) {
+				logError("Unknown target in environment variable "+defaultTargetEnv+":", name)
+				return 2
+			}
+			names[name] = struct{}{}
+		}
+	}
+
 	if !defaults && len(names) == 0 {
-		usage(2)
+		return usage(2)
 	}
 
 	var targets []Task
@@ -715,19 +2800,477 @@ func Main(getTargets func() Tasks, main string, deps ...string) {
 
 	for name := range names {
 		if _, ok := found[name]; !ok {
-			fmt.Fprintln(os.Stderr, "Unknown target:", name)
-			os.Exit(2)
+			logError("Unknown target:", name)
+			return 2
+		}
+	}
+
+	if !noLock {
+		lock, err := lockBuild(lockFilename)
+		if err != nil {
+			logError(err)
+			return 1
 		}
+		defer lock.Close()
+	}
+
+	ctx := context.Background()
+	if deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, deadline)
+		defer cancel()
 	}
 
-	cache := make(map[*tag]struct{})
+	failed := false
+
+	r := newRunner(ctx)
 	for _, task := range targets {
-		if !run(task, cache) {
-			fmt.Println("Nothing to be done for", task.name)
+		worked, err := r.run(task)
+		if errors.Is(err, ErrStop) {
+			worked, err = true, nil
+		}
+		if err != nil {
+			if isBrokenPipe(err) {
+				return exitBrokenPipe
+			}
+			if errors.Is(err, context.DeadlineExceeded) {
+				logError("Build deadline exceeded")
+				return exitDeadline
+			}
+			logError(err)
+			if !keepGoing {
+				return 1
+			}
+			failed = true
+			continue
+		}
+		if !worked && !task.quiet && !quiet {
+			logInfo("Nothing to be done for", task.name)
+		}
+	}
+
+	if brokenPipeError() != nil {
+		return exitBrokenPipe
+	}
+	if failed {
+		return 1
+	}
+
+	if listOutputs {
+		for _, name := range ProducedFiles() {
+			if _, err := fmt.Println(name); err != nil && isBrokenPipe(err) {
+				return exitBrokenPipe
+			}
+		}
+	}
+
+	if !dryRun {
+		if err := saveCache(); err != nil {
+			logWarningf("Cache: %v", err)
+		}
+		if err := saveDirStates(); err != nil {
+			logWarningf("Directory state: %v", err)
+		}
+	}
+
+	return 0
+}
+
+// exitDeadline is the exit code when --deadline is exceeded.  It is the same
+// as timeout(1) uses.
+const exitDeadline = 124
+
+// lockFilename is used to prevent concurrent builds in the same directory.
+const lockFilename = ".make.lock"
+
+// commandTimeoutEnv is the environment variable which specifies the default
+// value of the --command-timeout option.
+const commandTimeoutEnv = "MAKE_COMMAND_TIMEOUT"
+
+var (
+	deadline       time.Duration
+	commandTimeout time.Duration
+	listTargets    bool
+	noLock         bool
+	quiet          bool
+	listOutputs    bool
+	why            bool
+	dryRun         bool
+	keepGoing      bool
+	useSyslog      bool
+	verbose        bool
+	onlyLabels     map[string]struct{}
+	skipLabels     map[string]struct{}
+)
+
+// saveState takes a snapshot of the options, variables and other global state
+// which is modified by MainArgs.  The returned function restores it.
+func saveState() (restore func()) {
+	var (
+		savedDeadline       = deadline
+		savedCommandTimeout = commandTimeout
+		savedListTargets    = listTargets
+		savedNoLock         = noLock
+		savedQuiet          = quiet
+		savedListOutputs    = listOutputs
+		savedWhy            = why
+		savedDryRun         = dryRun
+		savedKeepGoing      = keepGoing
+		savedUseSyslog      = useSyslog
+		savedVerbose        = verbose
+		savedOnlyLabels     = onlyLabels
+		savedSkipLabels     = skipLabels
+		savedSpinner        = spinnerEnabled
+		savedPlanFilename   = plan.filename
+		savedSyslogger      = syslogger
+		savedGlobalDeps     = globalDeps
+	)
+
+	progress.mu.Lock()
+	savedProgressEnabled := progress.enabled
+	savedProgressEnc := progress.enc
+	progress.mu.Unlock()
+
+	varsMu.Lock()
+	savedVars := copyVars(Vars)
+	savedVarDefaults := copyVars(varDefaults)
+	varsMu.Unlock()
+
+	produced.mu.Lock()
+	savedProduced := append([]string(nil), produced.files...)
+	produced.mu.Unlock()
+
+	cache.mu.Lock()
+	savedCacheFilename := cache.filename
+	cache.mu.Unlock()
+
+	memo.mu.Lock()
+	savedMemo := make(map[string]interface{}, len(memo.values))
+	for k, v := range memo.values {
+		savedMemo[k] = v
+	}
+	memo.mu.Unlock()
+
+	pendingDirStates.mu.Lock()
+	savedDirStates := make(map[string]*dirState, len(pendingDirStates.states))
+	for k, v := range pendingDirStates.states {
+		savedDirStates[k] = v
+	}
+	pendingDirStates.mu.Unlock()
+
+	secrets.mu.Lock()
+	savedSecrets := append([]string(nil), secrets.values...)
+	secrets.mu.Unlock()
+
+	return func() {
+		deadline = savedDeadline
+		commandTimeout = savedCommandTimeout
+		listTargets = savedListTargets
+		noLock = savedNoLock
+		quiet = savedQuiet
+		listOutputs = savedListOutputs
+		why = savedWhy
+		dryRun = savedDryRun
+		keepGoing = savedKeepGoing
+		useSyslog = savedUseSyslog
+		verbose = savedVerbose
+		onlyLabels = savedOnlyLabels
+		skipLabels = savedSkipLabels
+		spinnerEnabled = savedSpinner
+		plan.filename = savedPlanFilename
+		syslogger = savedSyslogger
+		globalDeps = savedGlobalDeps
+
+		progress.mu.Lock()
+		progress.enabled = savedProgressEnabled
+		progress.enc = savedProgressEnc
+		progress.mu.Unlock()
+
+		varsMu.Lock()
+		Vars = savedVars
+		varDefaults = savedVarDefaults
+		varsComputing = make(map[string]struct{})
+		varsMu.Unlock()
+
+		brokenPipe.mu.Lock()
+		brokenPipe.err = nil
+		brokenPipe.mu.Unlock()
+
+		produced.mu.Lock()
+		produced.files = savedProduced
+		produced.seen = make(map[string]struct{})
+		for _, filename := range savedProduced {
+			produced.seen[filename] = struct{}{}
+		}
+		produced.mu.Unlock()
+
+		// The cache is loaded again from the file.
+		cache.mu.Lock()
+		cache.filename = savedCacheFilename
+		cache.loaded = false
+		cache.dirty = false
+		cache.data = cacheFile{}
+		cache.mu.Unlock()
+
+		memo.mu.Lock()
+		memo.values = savedMemo
+		memo.mu.Unlock()
+
+		pendingDirStates.mu.Lock()
+		pendingDirStates.states = savedDirStates
+		pendingDirStates.mu.Unlock()
+
+		secrets.mu.Lock()
+		secrets.values = savedSecrets
+		secrets.mu.Unlock()
+	}
+}
+
+func copyVars(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+type option struct {
+	short   string // Optional single-letter alias.
+	name    string
+	metavar string // Empty if the option doesn't take a value.
+	help    string
+	set     func(value string) error
+}
+
+var options = []option{
+	{
+		name:    "--deadline",
+		metavar: "DURATION",
+		help:    "Abort the build if it takes longer than DURATION (e.g. 30m)",
+		set: func(value string) (err error) {
+			deadline, err = time.ParseDuration(value)
+			return
+		},
+	},
+	{
+		name:    "--command-timeout",
+		metavar: "DURATION",
+		help:    "Kill commands which take longer than DURATION (default from " + commandTimeoutEnv + ")",
+		set: func(value string) (err error) {
+			commandTimeout, err = time.ParseDuration(value)
+			return
+		},
+	},
+	{
+		name: "--targets",
+		help: "List target names and exit",
+		set: func(string) error {
+			listTargets = true
+			return nil
+		},
+	},
+	{
+		name: "--no-lock",
+		help: "Don't prevent concurrent builds using " + lockFilename,
+		set: func(string) error {
+			noLock = true
+			return nil
+		},
+	},
+	{
+		name: "--quiet",
+		help: "Don't print Echo messages or report targets which had nothing to be done",
+		set: func(string) error {
+			quiet = true
+			return nil
+		},
+	},
+	{
+		name: "--list-outputs",
+		help: "List the files created or installed by the build",
+		set: func(string) error {
+			listOutputs = true
+			return nil
+		},
+	},
+	{
+		name: "--why",
+		help: "Report tasks which are skipped due to conditions",
+		set: func(string) error {
+			why = true
+			return nil
+		},
+	},
+	{
+		name:    "--only",
+		metavar: "LABEL",
+		help:    "Run only tasks with the label (and their subtasks)",
+		set: func(value string) error {
+			return addLabels(&onlyLabels, value)
+		},
+	},
+	{
+		name:    "--skip",
+		metavar: "LABEL",
+		help:    "Don't run tasks with the label (or their subtasks)",
+		set: func(value string) error {
+			return addLabels(&skipLabels, value)
+		},
+	},
+	{
+		short: "-k",
+		name:  "--keep-going",
+		help:  "Continue with other targets after a target fails",
+		set: func(string) error {
+			keepGoing = true
+			return nil
+		},
+	},
+	{
+		short: "-n",
+		name:  "--dry-run",
+		help:  "Print commands instead of running them; functions are skipped",
+		set: func(string) error {
+			dryRun = true
+			return nil
+		},
+	},
+	{
+		name:    "--plan-out",
+		metavar: "FILE",
+		help:    "Write the commands and condition results to FILE as JSON lines (implies --dry-run)",
+		set: func(value string) error {
+			plan.filename = value
+			dryRun = true
+			return nil
+		},
+	},
+	{
+		name:    "--progress",
+		metavar: "FORMAT",
+		help:    "Write task events to stderr in FORMAT (json)",
+		set:     setProgress,
+	},
+	{
+		name: "--syslog",
+		help: "Send messages also to the system log",
+		set: func(string) error {
+			useSyslog = true
+			return nil
+		},
+	},
+	{
+		name: "--verbose",
+		help: "Print full output of commands with collapsed output",
+		set: func(string) error {
+			verbose = true
+			return nil
+		},
+	},
+	{
+		name: "--spinner",
+		help: "Show progress of silent commands on terminal",
+		set: func(string) error {
+			spinnerEnabled = true
+			return nil
+		},
+	},
+}
+
+// addLabels from a comma-separated list.  The option may be repeated.
+func addLabels(set *map[string]struct{}, value string) error {
+	for _, label := range strings.Split(value, ",") {
+		if label == "" {
+			return errors.New("empty label")
+		}
+		if *set == nil {
+			*set = make(map[string]struct{})
+		}
+		(*set)[label] = struct{}{}
+	}
+	return nil
+}
+
+// expandResponseFiles replaces @file arguments with the lines of the files.
+// Empty lines and lines starting with # are skipped.  Nested @file references
+// are not expanded.
+func expandResponseFiles(args []string) (expanded []string, err error) {
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "@") {
+			expanded = append(expanded, arg)
+			continue
+		}
+
+		data, err := ioutil.ReadFile(arg[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				expanded = append(expanded, line)
+			}
+		}
+	}
+
+	return expanded, nil
+}
+
+// parseOptions consumes the recognized options.  Remaining arguments are
+// returned.  Option values may be specified as --name=value or --name value.
+func parseOptions(args []string) (remaining []string, err error) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		name := arg
+		value := ""
+		hasValue := false
+		if j := strings.Index(arg, "="); j >= 0 && strings.HasPrefix(arg, "--") {
+			name = arg[:j]
+			value = arg[j+1:]
+			hasValue = true
+		}
+
+		var o *option
+		for k := range options {
+			if options[k].name == name || (options[k].short != "" && options[k].short == name) {
+				o = &options[k]
+				break
+			}
+		}
+		if o == nil {
+			remaining = append(remaining, arg)
+			continue
+		}
+
+		if o.metavar == "" {
+			if hasValue {
+				return nil, fmt.Errorf("Option %s doesn't take a value", name)
+			}
+		} else if !hasValue {
+			if i+1 == len(args) {
+				return nil, fmt.Errorf("Option %s requires a value", name)
+			}
+			i++
+			value = args[i]
+		}
+
+		if err := o.set(value); err != nil {
+			return nil, fmt.Errorf("Option %s: %v", name, err)
 		}
 	}
 
-	os.Exit(0)
+	return remaining, nil
+}
+
+func hasTarget(targets []Task, name string) bool {
+	for _, task := range targets {
+		if task.name == name {
+			return true
+		}
+	}
+	return false
 }
 
 func validateTargets(targets []Task) (defaults bool) {
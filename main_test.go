@@ -0,0 +1,303 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestFlatten(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		input  []interface{}
+		output []string
+	}{
+		{
+			name:   "empty",
+			input:  nil,
+			output: nil,
+		},
+		{
+			name:   "strings",
+			input:  []interface{}{"a", []string{"b", "c"}},
+			output: []string{"a", "b", "c"},
+		},
+		{
+			name: "func interface",
+			input: []interface{}{
+				func() interface{} { return "a" },
+			},
+			output: []string{"a"},
+		},
+		{
+			name: "func interface slice",
+			input: []interface{}{
+				func() []interface{} { return []interface{}{"a", []string{"b"}} },
+			},
+			output: []string{"a", "b"},
+		},
+		{
+			name: "func interface returning func interface",
+			input: []interface{}{
+				func() interface{} {
+					return func() interface{} {
+						return func() interface{} { return "a" }
+					}
+				},
+			},
+			output: []string{"a"},
+		},
+		{
+			name: "func interface slice returning funcs",
+			input: []interface{}{
+				"a",
+				func() []interface{} {
+					return []interface{}{
+						func() interface{} { return []string{"b", "c"} },
+						func() []interface{} {
+							return []interface{}{
+								func() []string { return []string{"d"} },
+								[]interface{}{"e", map[string]string{"F": "f"}},
+							}
+						},
+					}
+				},
+				"g",
+			},
+			output: []string{"a", "b", "c", "d", "e", "F=f", "g"},
+		},
+		{
+			name: "func interface returning func interface slice",
+			input: []interface{}{
+				func() interface{} {
+					return func() []interface{} {
+						return []interface{}{Env{"B": "2", "A": "1"}}
+					}
+				},
+			},
+			output: []string{"A=1", "B=2"},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if output := Flatten(c.input...); !reflect.DeepEqual(output, c.output) {
+				t.Errorf("Flatten returned %q, expected %q", output, c.output)
+			}
+		})
+	}
+}
+
+func TestFlattenPanic(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		input []interface{}
+	}{
+		{
+			name:  "int",
+			input: []interface{}{1},
+		},
+		{
+			name:  "nested int",
+			input: []interface{}{[]interface{}{"a", 1}},
+		},
+		{
+			name: "func interface returning int",
+			input: []interface{}{
+				func() interface{} { return 1 },
+			},
+		},
+		{
+			name: "func interface slice returning bool",
+			input: []interface{}{
+				func() []interface{} {
+					return []interface{}{
+						func() interface{} { return true },
+					}
+				},
+			},
+		},
+		{
+			name: "func returning error",
+			input: []interface{}{
+				func() error { return nil },
+			},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("Flatten did not panic")
+				}
+			}()
+
+			Flatten(c.input...)
+		})
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("MAKE_TEST_SET", "value")
+	os.Unsetenv("MAKE_TEST_UNSET")
+	defer os.Unsetenv("MAKE_TEST_SET")
+
+	for _, c := range [][2]string{
+		{"", ""},
+		{"plain", "plain"},
+		{"$MAKE_TEST_SET", "value"},
+		{"${MAKE_TEST_SET}/lib", "value/lib"},
+		{"$MAKE_TEST_SET.x", "value.x"},
+		{"$MAKE_TEST_UNSET/lib", "$MAKE_TEST_UNSET/lib"},
+		{"${MAKE_TEST_UNSET}", "${MAKE_TEST_UNSET}"},
+		{"$$MAKE_TEST_SET", "$MAKE_TEST_SET"},
+		{"$@ $? $- $1 $", "$@ $? $- $1 $"},
+		{"${MAKE_TEST_SET", "${MAKE_TEST_SET"},
+		{"${} ${1x} ${a-b}", "${} ${1x} ${a-b}"},
+	} {
+		if output := expandEnv(c[0]); output != c[1] {
+			t.Errorf("expandEnv(%q) returned %q, expected %q", c[0], output, c[1])
+		}
+	}
+}
+
+func TestFinallyAfterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var ran bool
+
+	task := Func(func() error {
+		cancel()
+		return ctx.Err()
+	}).Finally(Func(func() error {
+		ran = true
+		return nil
+	}))
+
+	if _, err := newRunner(ctx).run(task); !errors.Is(err, context.Canceled) {
+		t.Errorf("run returned %v, expected %v", err, context.Canceled)
+	}
+	if !ran {
+		t.Error("cleanup task did not run")
+	}
+}
+
+func TestMainArgsTwice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "make-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	type result struct {
+		value    string
+		produced int
+		recalled bool
+	}
+
+	var results []result
+
+	getTargets := func() (targets Tasks) {
+		value := Getvar("V", "default")
+
+		targets.Add(TargetDefault("all",
+			Func(func() error {
+				_, recalled := Recall("key")
+				results = append(results, result{value, len(ProducedFiles()), recalled})
+				recordOutput("file")
+				return nil
+			}),
+			Memo("key", func() (interface{}, error) { return 1, nil }),
+		))
+		return
+	}
+
+	if code := MainArgs([]string{"--no-lock", "--quiet", "V=x"}, getTargets, ""); code != 0 {
+		t.Fatal("first call returned", code)
+	}
+	if code := MainArgs([]string{"--no-lock"}, getTargets, ""); code != 0 {
+		t.Fatal("second call returned", code)
+	}
+
+	expected := []result{
+		{"x", 0, false},
+		{"default", 0, false},
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("results: %v, expected %v", results, expected)
+	}
+	if quiet {
+		t.Error("quiet option is still set")
+	}
+}
+
+func TestMemoReset(t *testing.T) {
+	var computed int
+
+	task := Memo("key", func() (interface{}, error) {
+		computed++
+		return computed, nil
+	})
+
+	r := newRunner(context.Background())
+	if _, err := r.run(task); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.rerunner(context.Background()).run(task); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newRunner(context.Background()).run(task); err != nil {
+		t.Fatal(err)
+	}
+
+	if computed != 3 {
+		t.Errorf("value was computed %d times, expected 3", computed)
+	}
+	if value, _ := Recall("key"); value != 3 {
+		t.Errorf("recalled %v, expected 3", value)
+	}
+}
+
+func TestKeepGoing(t *testing.T) {
+	keepGoing = true
+	defer func() { keepGoing = false }()
+
+	var ran []string
+
+	step := func(name string) Task {
+		return Func(func() error {
+			ran = append(ran, name)
+			return nil
+		})
+	}
+
+	task := Target("all",
+		Target("build", Fail("unsupported"), step("build")),
+		Target("test", step("test")),
+		step("all"),
+	)
+
+	_, err := newRunner(context.Background()).run(task)
+
+	var kept *keptGoingError
+	if !errors.As(err, &kept) || kept.n != 1 {
+		t.Errorf("run returned %v, expected 1 failed target", err)
+	}
+	if expected := []string{"test"}; !reflect.DeepEqual(ran, expected) {
+		t.Errorf("ran %v, expected %v", ran, expected)
+	}
+}
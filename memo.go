@@ -0,0 +1,108 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"sync"
+)
+
+var memo struct {
+	mu     sync.Mutex
+	values map[string]interface{}
+}
+
+// Memo task computes a value and stores it under key for the rest of the
+// build.  If a value has already been stored under key, compute is not
+// called.  Tasks which run after the memo task can read the value using
+// Recall.  The values are discarded when a new build starts, or when Serve
+// runs tasks again.
+func Memo(key string, compute func() (interface{}, error)) Task {
+	return Func(func() error {
+		if _, found := Recall(key); found {
+			return nil
+		}
+
+		value, err := compute()
+		if err != nil {
+			return err
+		}
+
+		memo.mu.Lock()
+		defer memo.mu.Unlock()
+
+		if _, found := memo.values[key]; !found {
+			storeMemo(key, value)
+		}
+		return nil
+	})
+}
+
+// storeMemo value.  memo.mu must be held.
+func storeMemo(key string, value interface{}) {
+	if memo.values == nil {
+		memo.values = make(map[string]interface{})
+	}
+	memo.values[key] = value
+}
+
+func resetMemo() {
+	memo.mu.Lock()
+	defer memo.mu.Unlock()
+	memo.values = nil
+}
+
+// Recall a value stored by a Memo task.  It is safe to call concurrently.
+func Recall(key string) (value interface{}, found bool) {
+	memo.mu.Lock()
+	defer memo.mu.Unlock()
+
+	value, found = memo.values[key]
+	return
+}
+
+// condGeneration is incremented whenever tasks are run again (e.g. by Serve),
+// which invalidates cached conditions.
+var condGeneration struct {
+	mu sync.Mutex
+	n  uint64
+}
+
+func nextCondGeneration() {
+	condGeneration.mu.Lock()
+	defer condGeneration.mu.Unlock()
+	condGeneration.n++
+}
+
+func currentCondGeneration() uint64 {
+	condGeneration.mu.Lock()
+	defer condGeneration.mu.Unlock()
+	return condGeneration.n
+}
+
+// CacheCond returns a condition which calls cond at most once per build, and
+// returns the same result afterwards.  It is useful for expensive conditions
+// which are used in multiple places.  The filesystem is assumed to be stable
+// during the build: if a task modifies files which cond inspects, the cached
+// result becomes stale.  When Serve runs tasks again, the result is discarded.
+func CacheCond(cond func() bool) func() bool {
+	var (
+		mu     sync.Mutex
+		cached bool
+		gen    uint64
+		result bool
+	)
+
+	return func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if g := currentCondGeneration(); !cached || gen != g {
+			result = cond()
+			cached = true
+			gen = g
+		}
+		return result
+	}
+}
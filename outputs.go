@@ -0,0 +1,91 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+var produced struct {
+	mu    sync.Mutex
+	files []string
+	seen  map[string]struct{}
+}
+
+// ProducedFiles returns the names of the files which have been created by
+// Install, InstallData and other tasks which produce files, in the order in
+// which they were produced.  It is safe to call concurrently.
+func ProducedFiles() []string {
+	produced.mu.Lock()
+	defer produced.mu.Unlock()
+
+	return append([]string(nil), produced.files...)
+}
+
+func recordOutput(filename string) {
+	produced.mu.Lock()
+	defer produced.mu.Unlock()
+
+	if _, found := produced.seen[filename]; found {
+		return
+	}
+	if produced.seen == nil {
+		produced.seen = make(map[string]struct{})
+	}
+	produced.seen[filename] = struct{}{}
+	produced.files = append(produced.files, filename)
+}
+
+// writeIfChanged replaces the file atomically unless it already has the
+// contents and permissions.  The modification time is set to
+// SOURCE_DATE_EPOCH if specified.
+func writeIfChanged(filename string, data []byte, perm os.FileMode) (written bool, err error) {
+	if old, err := ioutil.ReadFile(filename); err == nil && bytes.Equal(old, data) {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return false, err
+		}
+		if info.Mode().Perm() == perm {
+			return false, nil
+		}
+	}
+
+	logInfo("Writing", filename)
+
+	if err := mkdirAll(Dir(filename)); err != nil {
+		return false, err
+	}
+	if err := writeFileAtomic(filename, data, perm); err != nil {
+		return false, err
+	}
+
+	if t, ok := SourceDateEpoch(); ok {
+		if err := os.Chtimes(filename, t, t); err != nil {
+			return true, err
+		}
+	}
+
+	recordOutput(filename)
+	return true, nil
+}
+
+// WriteScript task writes an executable script file which starts with a
+// #!interpreter line followed by the body.  Newline is appended to the body
+// if needed.  The file is not modified if it's already up to date.
+func WriteScript(dest, interpreter string, body func() string) Task {
+	return actionFunc("write script "+dest, func() error {
+		text := body()
+		if !strings.HasSuffix(text, "\n") {
+			text += "\n"
+		}
+
+		_, err := writeIfChanged(dest, []byte("#!"+interpreter+"\n"+text), 0755)
+		return err
+	})
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// exitBrokenPipe is the exit code used when stdout is closed by reader.  It is
+// the same as shells report for processes killed by SIGPIPE.
+const exitBrokenPipe = 128 + 13
+
+// handleBrokenPipe makes writes to closed stdout or stderr return EPIPE
+// instead of killing the program with SIGPIPE, so that the situation can be
+// handled gracefully.  Child processes are not affected.
+func handleBrokenPipe() {
+	signal.Notify(make(chan os.Signal, 1), syscall.SIGPIPE)
+}
+
+// isBrokenPipe checks if err was caused by writing to a closed pipe, either by
+// this program or by a command.
+func isBrokenPipe(err error) bool {
+	if errors.Is(err, syscall.EPIPE) || errors.Is(err, os.ErrClosed) {
+		return true
+	}
+
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		status, ok := exit.Sys().(syscall.WaitStatus)
+		return ok && status.Signaled() && status.Signal() == syscall.SIGPIPE
+	}
+
+	return false
+}
+
+// brokenPipe holds the first broken pipe error encountered while writing to
+// stdout.
+var brokenPipe struct {
+	mu  sync.Mutex
+	err error
+}
+
+// checkBrokenPipe records err if it is a broken pipe error.  The build is
+// stopped quietly before the next task.
+func checkBrokenPipe(err error) {
+	if err != nil && isBrokenPipe(err) {
+		brokenPipe.mu.Lock()
+		defer brokenPipe.mu.Unlock()
+
+		if brokenPipe.err == nil {
+			brokenPipe.err = err
+		}
+	}
+}
+
+// brokenPipeError returns the error recorded by checkBrokenPipe, if any.
+func brokenPipeError() error {
+	brokenPipe.mu.Lock()
+	defer brokenPipe.mu.Unlock()
+	return brokenPipe.err
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// planStep is written as a JSON line by --plan-out.
+type planStep struct {
+	Type        string            `json:"type"` // "condition", "command" or "function".
+	Task        string            `json:"task,omitempty"`
+	Result      *bool             `json:"result,omitempty"`
+	Argv        []string          `json:"argv,omitempty"`
+	Env         map[string]string `json:"env,omitempty"`
+	Dir         string            `json:"dir,omitempty"`
+	Description string            `json:"description,omitempty"`
+}
+
+var plan struct {
+	filename string
+	file     *os.File
+	enc      *json.Encoder
+}
+
+func openPlan() error {
+	f, err := createFile(plan.filename)
+	if err != nil {
+		return err
+	}
+
+	plan.file = f
+	plan.enc = json.NewEncoder(f)
+	return nil
+}
+
+func closePlan() error {
+	if plan.file == nil {
+		return nil
+	}
+
+	err := plan.file.Close()
+	plan.file = nil
+	plan.enc = nil
+	return err
+}
+
+func planCondition(task Task, result bool) error {
+	if plan.enc == nil {
+		return nil
+	}
+
+	return plan.enc.Encode(planStep{
+		Type:   "condition",
+		Task:   task.summary(),
+		Result: &result,
+	})
+}
+
+func planCommand(task Task) error {
+	if plan.enc == nil {
+		return nil
+	}
+
+	step := planStep{
+		Type: "command",
+		Dir:  task.dir,
+	}
+	for _, arg := range task.command {
+		step.Argv = append(step.Argv, maskSecrets(arg))
+	}
+	if len(task.env) > 0 {
+		step.Env = make(map[string]string)
+		for k, v := range task.env {
+			step.Env[k] = maskEnvValue(v)
+		}
+	}
+	return plan.enc.Encode(step)
+}
+
+func planFunction(task Task) error {
+	if plan.enc == nil {
+		return nil
+	}
+
+	return plan.enc.Encode(planStep{
+		Type:        "function",
+		Description: task.Describe(),
+	})
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// progressEvent is written as a JSON line to stderr by --progress=json.
+type progressEvent struct {
+	Event    string  `json:"event"` // "start", "finish" or "skip".
+	Task     string  `json:"task"`
+	Status   string  `json:"status,omitempty"`   // "ok", "failed" or "stopped".
+	Duration float64 `json:"duration,omitempty"` // Seconds.
+	Error    string  `json:"error,omitempty"`
+}
+
+var progress struct {
+	mu      sync.Mutex
+	enabled bool
+	enc     *json.Encoder
+}
+
+func setProgress(format string) error {
+	if format != "json" {
+		return fmt.Errorf("unsupported format: %s", format)
+	}
+
+	progress.enabled = true
+	progress.enc = json.NewEncoder(os.Stderr)
+	return nil
+}
+
+func emitProgress(ev progressEvent) {
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+
+	progress.enc.Encode(ev)
+}
+
+// progressTask reports the start of a task, and returns a function which
+// reports its finish.
+func progressTask(task Task) (finish func(error)) {
+	desc := maskSecrets(task.Describe())
+	emitProgress(progressEvent{Event: "start", Task: desc})
+	start := time.Now()
+
+	return func(err error) {
+		ev := progressEvent{
+			Event:    "finish",
+			Task:     desc,
+			Status:   "ok",
+			Duration: time.Since(start).Seconds(),
+		}
+		switch {
+		case errors.Is(err, ErrStop):
+			ev.Status = "stopped"
+		case err != nil:
+			ev.Status = "failed"
+			ev.Error = maskSecrets(err.Error())
+		}
+		emitProgress(ev)
+	}
+}
+
+func progressSkip(task Task) {
+	emitProgress(progressEvent{Event: "skip", Task: maskSecrets(task.summary())})
+}
@@ -0,0 +1,18 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package make
+
+import (
+	"os/exec"
+)
+
+// runPTY runs the command without a pseudo-terminal on this platform.
+func runPTY(cmd *exec.Cmd) error {
+	logWarningf("Pseudo-terminals are not supported on %s", GOOS)
+	return cmd.Run()
+}
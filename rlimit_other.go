@@ -0,0 +1,18 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd)
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd
+
+package make
+
+import (
+	"os/exec"
+)
+
+// apply is a no-op on this platform.
+func (l *resourceLimits) apply(cmd *exec.Cmd) error {
+	logWarningf("Resource limits are not supported on %s", GOOS)
+	return nil
+}
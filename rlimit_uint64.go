@@ -0,0 +1,16 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || linux || netbsd
+// +build darwin linux netbsd
+
+package make
+
+import (
+	"syscall"
+)
+
+func rlimit(n uint64) *syscall.Rlimit {
+	return &syscall.Rlimit{Cur: n, Max: n}
+}
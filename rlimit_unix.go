@@ -0,0 +1,74 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd
+// +build darwin dragonfly freebsd linux netbsd
+
+package make
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// rlimitEnv is set for a child process which is a re-executed copy of this
+// program.  It sets the resource limits and executes the actual command.
+const rlimitEnv = "IMPORT_NAME_MAKE_RLIMIT"
+
+func init() {
+	if spec, found := os.LookupEnv(rlimitEnv); found {
+		os.Unsetenv(rlimitEnv)
+		execWithLimits(spec)
+	}
+}
+
+func execWithLimits(spec string) {
+	var mem, cpu uint64
+	if _, err := fmt.Sscanf(spec, "%d %d", &mem, &cpu); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(127)
+	}
+
+	if mem > 0 {
+		if err := syscall.Setrlimit(syscall.RLIMIT_AS, rlimit(mem)); err != nil {
+			fmt.Fprintln(os.Stderr, "memory limit:", err)
+			os.Exit(127)
+		}
+	}
+	if cpu > 0 {
+		if err := syscall.Setrlimit(syscall.RLIMIT_CPU, rlimit(cpu)); err != nil {
+			fmt.Fprintln(os.Stderr, "CPU limit:", err)
+			os.Exit(127)
+		}
+	}
+
+	filename, err := exec.LookPath(os.Args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(127)
+	}
+
+	err = syscall.Exec(filename, os.Args[1:], os.Environ())
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(127)
+}
+
+// apply the limits by making the command re-execute this program, which sets
+// the limits before executing the actual command.
+func (l *resourceLimits) apply(cmd *exec.Cmd) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	cmd.Path = exe
+	cmd.Args = append([]string{exe}, cmd.Args...)
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d %d", rlimitEnv, l.mem, l.cpu))
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+const secretMask = "***"
+
+var secrets struct {
+	mu     sync.Mutex
+	values []string
+}
+
+func addSecret(value string) {
+	if value == "" {
+		return
+	}
+
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+
+	for _, s := range secrets.values {
+		if s == value {
+			return
+		}
+	}
+	secrets.values = append(secrets.values, value)
+}
+
+// maskSecrets replaces secret values in s.
+func maskSecrets(s string) string {
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+
+	for _, value := range secrets.values {
+		s = strings.Replace(s, value, secretMask, -1)
+	}
+	return s
+}
+
+// secretRefPrefix marks an environment variable value which refers to a
+// secret file (see SecretEnv).  Real values cannot contain NUL.
+const secretRefPrefix = "\x00secret:"
+
+// SecretEnv specifies an environment variable whose value is read from a file
+// when a command is run.  Trailing newline is removed.  The value is masked
+// when commands are printed and in the output of commands.  The value is not
+// expanded.
+func SecretEnv(key, file string) Env {
+	return Env{key: secretRefPrefix + file}
+}
+
+func isSecretRef(value string) bool {
+	return strings.HasPrefix(value, secretRefPrefix)
+}
+
+// readSecretRef reads the secret file referred to by value, and registers the
+// secret.
+func readSecretRef(value string) (string, error) {
+	data, err := ioutil.ReadFile(strings.TrimPrefix(value, secretRefPrefix))
+	if err != nil {
+		return "", err
+	}
+
+	secret := strings.TrimRight(string(data), "\r\n")
+	addSecret(secret)
+	return secret, nil
+}
+
+// maskEnvValue for printing.
+func maskEnvValue(value string) string {
+	if isSecretRef(value) {
+		return secretMask
+	}
+	return maskSecrets(value)
+}
+
+// RegisterSecret causes the value to be masked in printed commands and in the
+// output of commands.
+func RegisterSecret(value string) {
+	addSecret(value)
+}
+
+func haveSecrets() bool {
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+	return len(secrets.values) > 0
+}
+
+// secretWriter masks secrets in complete lines.  Lines are buffered, so flush
+// must be called at the end.
+type secretWriter struct {
+	out     io.Writer
+	partial []byte
+}
+
+// maxSecretLine limits buffering of output without newlines.
+const maxSecretLine = 64 * 1024
+
+func (w *secretWriter) Write(b []byte) (int, error) {
+	w.partial = append(w.partial, b...)
+
+	i := bytes.LastIndexByte(w.partial, '\n')
+	if i < 0 && len(w.partial) < maxSecretLine {
+		return len(b), nil
+	}
+
+	var lines []byte
+	if i < 0 {
+		lines, w.partial = w.partial, nil
+	} else {
+		lines, w.partial = w.partial[:i+1], w.partial[i+1:]
+	}
+
+	if _, err := io.WriteString(w.out, maskSecrets(string(lines))); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (w *secretWriter) flush() error {
+	if len(w.partial) == 0 {
+		return nil
+	}
+
+	_, err := io.WriteString(w.out, maskSecrets(string(w.partial)))
+	w.partial = nil
+	return err
+}
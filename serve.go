@@ -0,0 +1,173 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+	"time"
+)
+
+const (
+	watchInterval = 500 * time.Millisecond
+	stopTimeout   = 5 * time.Second
+)
+
+// Serve task starts a server command in the background and watches files.
+// When a watched file is added, removed or modified, onChange is run and the
+// server is restarted.  Failure of onChange is reported, but the server keeps
+// running.  The task finishes when the program is interrupted (e.g. Ctrl-C);
+// the server is stopped.  The server command is prepared like other command
+// tasks: its directory, environment function and the command hook are applied.
+func Serve(server Task, watched func() []string, onChange Task) Task {
+	return Task{
+		custom: func(r *runner) error {
+			if len(server.command) == 0 {
+				return errors.New("Serve: server task is not a command")
+			}
+
+			ctx, stop := signal.NotifyContext(r.ctx, os.Interrupt)
+			defer stop()
+
+			// Secrets may be registered while the server is running.
+			stdout := &secretWriter{out: os.Stdout}
+			stderr := &secretWriter{out: os.Stderr}
+			defer stdout.flush()
+			defer stderr.flush()
+
+			start := func() (*process, error) {
+				task := server.hooked()
+				if len(task.command) == 0 {
+					return nil, errors.New("Serve: server command was skipped by command hook")
+				}
+
+				logInfo("Starting", task.commandline())
+				cmd, err := task.cmd(context.Background())
+				if err != nil {
+					return nil, err
+				}
+				cmd.Stdout = stdout
+				cmd.Stderr = stderr
+				return startProcess(cmd)
+			}
+
+			state := statFiles(watched)
+
+			p, err := start()
+			if err != nil {
+				return err
+			}
+			defer func() {
+				p.stop()
+			}()
+
+			ticker := time.NewTicker(watchInterval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return r.ctx.Err() // Interruption is not an error.
+
+				case <-ticker.C:
+				}
+
+				newState := statFiles(watched)
+				if newState.equal(state) {
+					continue
+				}
+				state = newState
+
+				if _, err := r.rerunner(ctx).run(onChange); err != nil && !errors.Is(err, ErrStop) {
+					logError(err)
+					continue
+				}
+
+				p.stop()
+				if p, err = start(); err != nil {
+					return err
+				}
+			}
+		},
+		tag: new(tag),
+	}
+}
+
+type fileState map[string]time.Time
+
+func statFiles(files func() []string) fileState {
+	state := make(fileState)
+	for _, name := range files() {
+		if info, err := os.Stat(name); err == nil {
+			state[name] = info.ModTime()
+		}
+	}
+	return state
+}
+
+func (a fileState) equal(b fileState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, t := range a {
+		if u, found := b[name]; !found || !u.Equal(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// process running in the background.
+type process struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+	err  error // Valid after done is closed.
+}
+
+func startProcess(cmd *exec.Cmd) (*process, error) {
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	p := &process{
+		cmd:  cmd,
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(p.done)
+		p.err = cmd.Wait()
+	}()
+	return p, nil
+}
+
+// stop the process by interrupting it, or killing it if it doesn't exit in a
+// timely fashion.  Returns the result of waiting.
+func (p *process) stop() error {
+	if p == nil {
+		return nil
+	}
+
+	select {
+	case <-p.done:
+		return p.err
+	default:
+	}
+
+	if err := p.cmd.Process.Signal(os.Interrupt); err != nil {
+		p.cmd.Process.Kill()
+	}
+
+	select {
+	case <-p.done:
+	case <-time.After(stopTimeout):
+		p.cmd.Process.Kill()
+		<-p.done
+	}
+
+	return p.err
+}
@@ -0,0 +1,37 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"sync"
+)
+
+// Sources is a memoized list of files.
+type Sources struct {
+	patterns []string
+	once     sync.Once
+	files    []string
+}
+
+// SourceSet globs the patterns when the files are needed for the first time.
+// The same results are used for all purposes after that, so the command
+// arguments and dependency checks are guaranteed to be consistent.
+func SourceSet(patterns ...string) *Sources {
+	return &Sources{patterns: patterns}
+}
+
+// Files globs (or terminates program on error) on first call.  The method
+// value can be used as an argument to Flatten or Outdated.
+func (s *Sources) Files() []string {
+	s.once.Do(func() {
+		s.files = Glob(s.patterns...)
+	})
+	return s.files
+}
+
+// Outdated condition using the files as sources.
+func (s *Sources) Outdated(target string) func() bool {
+	return Outdated(target, s.Files)
+}
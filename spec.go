@@ -0,0 +1,243 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// spec file format (see LoadSpec).
+type spec struct {
+	Targets []specTarget `json:"targets"`
+}
+
+type specTarget struct {
+	Name    string     `json:"name"`
+	Default bool       `json:"default"`
+	Tasks   []specStep `json:"tasks"`
+}
+
+type specStep struct {
+	Command []string          `json:"command"`
+	Env     map[string]string `json:"env"`
+	Dir     string            `json:"dir"`
+	Target  string            `json:"target"`
+	If      *specCond         `json:"if"`
+	Then    []specStep        `json:"then"`
+}
+
+type specCond struct {
+	Outdated *specOutdated `json:"outdated"`
+	Missing  string        `json:"missing"`
+}
+
+type specOutdated struct {
+	Target  string   `json:"target"`
+	Sources []string `json:"sources"`
+}
+
+// LoadSpec reads target definitions from a JSON file.  Only JSON is supported
+// because YAML and TOML parsers would be external dependencies.  Example:
+//
+//	{
+//	  "targets": [
+//	    {
+//	      "name": "build",
+//	      "default": true,
+//	      "tasks": [
+//	        {"target": "generate"},
+//	        {
+//	          "if": {
+//	            "outdated": {"target": "bin/app", "sources": ["main.go"]}
+//	          },
+//	          "then": [
+//	            {
+//	              "command": ["go", "build", "-o", "bin/app"],
+//	              "env": {"CGO_ENABLED": "0"}
+//	            }
+//	          ]
+//	        }
+//	      ]
+//	    },
+//	    {
+//	      "name": "generate",
+//	      "tasks": [
+//	        {
+//	          "if": {"missing": "gen.go"},
+//	          "then": [{"command": ["go", "generate"]}]
+//	        }
+//	      ]
+//	    }
+//	  ]
+//	}
+//
+// A step is a command (with optional env and dir), a reference to another
+// target (which is run only once), or a condition (outdated or missing) with
+// steps to run if it's true.  Unknown fields are errors.
+func LoadSpec(path string) (Tasks, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var s spec
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&s); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	l := specLoader{
+		spec:    &s,
+		targets: make(map[string]*Task),
+		loading: make(map[string]bool),
+	}
+
+	seen := make(map[string]struct{})
+	for _, t := range s.Targets {
+		if t.Name == "" {
+			return nil, fmt.Errorf("%s: target without name", path)
+		}
+		if _, dup := seen[t.Name]; dup {
+			return nil, fmt.Errorf("%s: duplicate target: %s", path, t.Name)
+		}
+		seen[t.Name] = struct{}{}
+	}
+
+	var tasks Tasks
+	for _, t := range s.Targets {
+		task, err := l.target(t.Name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		tasks = append(tasks, *task)
+	}
+	return tasks, nil
+}
+
+type specLoader struct {
+	spec    *spec
+	targets map[string]*Task
+	loading map[string]bool
+}
+
+func (l *specLoader) lookup(name string) *specTarget {
+	for i := range l.spec.Targets {
+		if l.spec.Targets[i].Name == name {
+			return &l.spec.Targets[i]
+		}
+	}
+	return nil
+}
+
+func (l *specLoader) target(name string) (*Task, error) {
+	if task := l.targets[name]; task != nil {
+		return task, nil
+	}
+	if l.loading[name] {
+		return nil, fmt.Errorf("target %s refers to itself", name)
+	}
+
+	t := l.lookup(name)
+	if t == nil {
+		return nil, fmt.Errorf("unknown target: %s", name)
+	}
+
+	l.loading[name] = true
+	defer delete(l.loading, name)
+
+	tasks, err := l.steps(t.Tasks)
+	if err != nil {
+		return nil, fmt.Errorf("target %s: %v", name, err)
+	}
+
+	var task Task
+	if t.Default {
+		task = TargetDefault(name, tasks...)
+	} else {
+		task = Target(name, tasks...)
+	}
+	l.targets[name] = &task
+	return &task, nil
+}
+
+func (l *specLoader) steps(steps []specStep) (tasks []Task, err error) {
+	for _, s := range steps {
+		task, err := l.step(s)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	return
+}
+
+func (l *specLoader) step(s specStep) (Task, error) {
+	var kinds []string
+	if len(s.Command) > 0 {
+		kinds = append(kinds, "command")
+	}
+	if s.Target != "" {
+		kinds = append(kinds, "target")
+	}
+	if s.If != nil {
+		kinds = append(kinds, "if")
+	}
+	if len(kinds) != 1 {
+		return Task{}, errors.New("step must have exactly one of command, target or if")
+	}
+
+	if (s.Env != nil || s.Dir != "") && s.Command == nil {
+		return Task{}, errors.New("env and dir are only allowed with command")
+	}
+	if s.Then != nil && s.If == nil {
+		return Task{}, errors.New("then is only allowed with if")
+	}
+
+	switch {
+	case s.Command != nil:
+		task := Env(s.Env).Command(s.Command)
+		task.dir = s.Dir
+		return task, nil
+
+	case s.Target != "":
+		task, err := l.target(s.Target)
+		if err != nil {
+			return Task{}, err
+		}
+		return *task, nil
+
+	default:
+		cond, err := specCondition(s.If)
+		if err != nil {
+			return Task{}, err
+		}
+		tasks, err := l.steps(s.Then)
+		if err != nil {
+			return Task{}, err
+		}
+		return If(cond, tasks...), nil
+	}
+}
+
+func specCondition(c *specCond) (func() bool, error) {
+	switch {
+	case c.Outdated != nil && c.Missing == "":
+		if c.Outdated.Target == "" {
+			return nil, errors.New("outdated condition without target")
+		}
+		return OutdatedFiles(c.Outdated.Target, c.Outdated.Sources...), nil
+
+	case c.Missing != "" && c.Outdated == nil:
+		return Missing(c.Missing), nil
+
+	default:
+		return nil, errors.New("condition must have exactly one of outdated or missing")
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	spinnerDelay    = time.Second
+	spinnerInterval = 100 * time.Millisecond
+)
+
+var spinnerEnabled bool
+
+var spinnerFrames = []byte(`|/-\`)
+
+// spinner shows the name and elapsed time of a running command on the
+// terminal after the command has been silent for a while.  It is erased when
+// the command writes output or finishes.
+type spinner struct {
+	mu     sync.Mutex
+	name   string
+	start  time.Time
+	quiet  time.Time // Time of last output.
+	frame  int
+	shown  bool
+	done   chan struct{}
+	exited chan struct{}
+}
+
+// startSpinner returns nil if spinner is disabled or stderr is not a terminal.
+func startSpinner(name string) *spinner {
+	if !spinnerEnabled || !isTerminal(os.Stderr) {
+		return nil
+	}
+
+	now := time.Now()
+	s := &spinner{
+		name:   name,
+		start:  now,
+		quiet:  now,
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	go s.loop()
+	return s
+}
+
+func (s *spinner) loop() {
+	defer close(s.exited)
+
+	ticker := time.NewTicker(spinnerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+
+		case now := <-ticker.C:
+			s.mu.Lock()
+			if now.Sub(s.quiet) >= spinnerDelay {
+				fmt.Fprintf(os.Stderr, "\r%c %s (%ds)\033[K", spinnerFrames[s.frame%len(spinnerFrames)], s.name, int(now.Sub(s.start).Seconds()))
+				s.frame++
+				s.shown = true
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// erase must be called with mutex locked.
+func (s *spinner) erase() {
+	if s.shown {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+		s.shown = false
+	}
+}
+
+// writer wraps command output so that the spinner is erased before writing.
+func (s *spinner) writer(w io.Writer) io.Writer {
+	if s == nil {
+		return w
+	}
+	return spinnerWriter{s, w}
+}
+
+func (s *spinner) stop() {
+	if s == nil {
+		return
+	}
+
+	close(s.done)
+	<-s.exited
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.erase()
+}
+
+type spinnerWriter struct {
+	s *spinner
+	w io.Writer
+}
+
+func (x spinnerWriter) Write(b []byte) (int, error) {
+	x.s.mu.Lock()
+	defer x.s.mu.Unlock()
+
+	x.s.erase()
+	x.s.quiet = time.Now()
+	return x.w.Write(b)
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// Stages task runs a pipeline of tasks which communicate via temporary files.
+// Each stage function is called at run time with the input and output
+// filenames of the stage; the input of the first stage is empty.  The output
+// of the last stage is renamed to dest with mode 0644.  The temporary files
+// are created in the directory of dest, and they are removed also on failure.
+func Stages(dest string, stages ...func(in, out string) Task) Task {
+	return Task{
+		custom: func(r *runner) error {
+			dir := Dir(dest)
+			if err := mkdirAll(dir); err != nil {
+				return err
+			}
+
+			var temps []string
+			defer func() {
+				for _, name := range temps {
+					os.Remove(name)
+				}
+			}()
+
+			var in string
+
+			for _, stage := range stages {
+				f, err := ioutil.TempFile(dir, ".stage*-"+Base(dest))
+				if err != nil {
+					return err
+				}
+				out := f.Name()
+				temps = append(temps, out)
+				if err := f.Close(); err != nil {
+					return err
+				}
+
+				if _, err := r.run(stage(in, out)); err != nil {
+					return err
+				}
+
+				in = out
+			}
+
+			if in == "" {
+				return nil
+			}
+			if err := os.Chmod(in, 0644); err != nil {
+				return err
+			}
+			if err := os.Rename(in, dest); err != nil {
+				return err
+			}
+			recordOutput(dest)
+			return nil
+		},
+		tag: new(tag),
+	}
+}
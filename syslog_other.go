@@ -0,0 +1,17 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package make
+
+import (
+	"fmt"
+)
+
+// openSyslog fails on this platform.
+func openSyslog(tag string) (func(level, msg string), error) {
+	return nil, fmt.Errorf("not supported on %s", GOOS)
+}
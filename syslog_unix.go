@@ -0,0 +1,31 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package make
+
+import (
+	"log/syslog"
+)
+
+// openSyslog returns a function which sends log messages to the system log.
+func openSyslog(tag string) (func(level, msg string), error) {
+	w, err := syslog.New(syslog.LOG_USER|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(level, msg string) {
+		switch level {
+		case LevelError:
+			w.Err(msg)
+		case LevelWarning:
+			w.Warning(msg)
+		default:
+			w.Info(msg)
+		}
+	}, nil
+}
@@ -0,0 +1,18 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package make
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// apply fails on this platform.
+func (u *userCredential) apply(cmd *exec.Cmd) error {
+	return fmt.Errorf("running commands as another user is not supported on %s", GOOS)
+}
@@ -0,0 +1,25 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package make
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// apply the credentials to the command.
+func (u *userCredential) apply(cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = new(syscall.SysProcAttr)
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid: uint32(u.uid),
+		Gid: uint32(u.gid),
+	}
+	return nil
+}
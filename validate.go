@@ -0,0 +1,75 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// ValidateJSON task checks that the files contain valid JSON.  All invalid
+// files are reported (with line and column numbers of syntax errors) before
+// the build fails.  Empty files are invalid.
+//
+// There is no YAML counterpart because parsing YAML would require an external
+// dependency.
+func ValidateJSON(files func() []string) Task {
+	return Func(func() error {
+		var invalid int
+
+		for _, filename := range files() {
+			data, err := ioutil.ReadFile(filename)
+			if err != nil {
+				return err
+			}
+
+			if line, column, err := validateJSON(data); err != nil {
+				if line > 0 {
+					logError(fmt.Sprintf("%s:%d:%d: %v", filename, line, column, err))
+				} else {
+					logError(fmt.Sprintf("%s: %v", filename, err))
+				}
+				invalid++
+			}
+		}
+
+		if invalid > 0 {
+			return fmt.Errorf("%d invalid JSON file(s)", invalid)
+		}
+		return nil
+	})
+}
+
+// validateJSON returns the position of a syntax error, or zeros if it's not
+// known.
+func validateJSON(data []byte) (line, column int, err error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return 0, 0, errors.New("empty file")
+	}
+
+	var x interface{}
+	err = json.Unmarshal(data, &x)
+
+	var syntax *json.SyntaxError
+	if errors.As(err, &syntax) {
+		line, column = lineColumn(data, syntax.Offset)
+	}
+	return
+}
+
+// lineColumn converts a byte offset to 1-based line and column numbers.
+func lineColumn(data []byte, offset int64) (line, column int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+
+	line = bytes.Count(before, []byte("\n")) + 1
+	column = len(before) - bytes.LastIndexByte(before, '\n')
+	return
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// VersionFile task writes a version string determined using git describe
+// (latest tag, commit and dirty state) to dest.  If git fails, a placeholder
+// version is used; it is derived from SOURCE_DATE_EPOCH if set.  The file is
+// not modified if the version hasn't changed.  The version string can be read
+// by subsequent tasks using Recall(dest).
+func VersionFile(dest string) Task {
+	return Func(func() error {
+		version := gitVersion()
+
+		memo.mu.Lock()
+		storeMemo(dest, version)
+		memo.mu.Unlock()
+
+		_, err := writeIfChanged(dest, []byte(version+"\n"), 0644)
+		return err
+	})
+}
+
+func gitVersion() string {
+	output, err := exec.Command("git", "describe", "--tags", "--always", "--dirty").Output()
+	if err == nil {
+		if s := strings.TrimSpace(string(output)); s != "" {
+			return s
+		}
+	}
+
+	if t, ok := SourceDateEpoch(); ok {
+		return "0.0.0-" + t.UTC().Format("20060102150405")
+	}
+	return "0.0.0-unknown"
+}
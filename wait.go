@@ -0,0 +1,128 @@
+// Copyright (c) 2021 Timo Savola. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package make
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	pollMinInterval = 100 * time.Millisecond
+	pollMaxInterval = time.Second
+	probeTimeout    = 2 * time.Second
+)
+
+// WaitPort task waits until a TCP connection can be established to addr
+// (host:port).  The build fails if it doesn't succeed within timeout.
+func WaitPort(addr string, timeout time.Duration) Task {
+	return Task{
+		custom: func(r *runner) error {
+			logInfo("Waiting for", addr)
+
+			var d net.Dialer
+
+			return poll(r.ctx, timeout, addr, func(ctx context.Context) error {
+				conn, err := d.DialContext(ctx, "tcp", addr)
+				if err != nil {
+					return err
+				}
+				return conn.Close()
+			})
+		},
+		tag: new(tag),
+	}
+}
+
+// WaitHTTP task waits until a GET request to url returns expectStatus, or
+// any 2xx status if expectStatus is 0.  Connection errors and unexpected
+// statuses are retried.  The build fails if it doesn't succeed within
+// timeout.
+func WaitHTTP(url string, expectStatus int, timeout time.Duration) Task {
+	return Task{
+		custom: func(r *runner) error {
+			logInfo("Waiting for", url)
+
+			return poll(r.ctx, timeout, url, func(ctx context.Context) error {
+				ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+				defer cancel()
+
+				req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+				if err != nil {
+					return err
+				}
+
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					return err
+				}
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+
+				if expectStatus == 0 {
+					if resp.StatusCode/100 != 2 {
+						return fmt.Errorf("status %s", resp.Status)
+					}
+				} else if resp.StatusCode != expectStatus {
+					return fmt.Errorf("status %s", resp.Status)
+				}
+				return nil
+			})
+		},
+		tag: new(tag),
+	}
+}
+
+// WaitFile task waits until path exists.  The build fails if it doesn't
+// appear within timeout.
+func WaitFile(path string, timeout time.Duration) Task {
+	return Task{
+		custom: func(r *runner) error {
+			logInfo("Waiting for", path)
+
+			return poll(r.ctx, timeout, path, func(context.Context) error {
+				_, err := os.Stat(path)
+				return err
+			})
+		},
+		tag: new(tag),
+	}
+}
+
+// poll calls try repeatedly with increasing intervals until it succeeds, or
+// timeout expires or parent context is done.
+func poll(parent context.Context, timeout time.Duration, what string, try func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	interval := pollMinInterval
+
+	for {
+		err := try(ctx)
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if e := parent.Err(); e != nil {
+				return e
+			}
+			return fmt.Errorf("timed out waiting for %s: %v", what, err)
+
+		case <-time.After(interval):
+		}
+
+		if interval *= 2; interval > pollMaxInterval {
+			interval = pollMaxInterval
+		}
+	}
+}